@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"io/fs"
+	"time"
+)
+
+// atime returns the modification time of a file, the access time is not portable.
+func atime(fi fs.FileInfo) time.Time {
+	return fi.ModTime()
+}
@@ -15,6 +15,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	_ "embed"
 
@@ -45,6 +46,7 @@ func dump(ctx context.Context) error {
 	}
 
 	wd = "/home/user"
+	now = func() time.Time { return time.Date(2024, 9, 1, 0, 0, 0, 0, time.UTC) }
 	var testfiles []string
 	if *flagFS == "" {
 		testfiles, _ = filepath.Glob("testdata/*.textar")
@@ -57,7 +59,10 @@ func dump(ctx context.Context) error {
 			return err
 		}
 		testfile = strings.TrimSuffix(filepath.Base(filename), ".textar")
-		rootfs = textar.FS(textar.Parse(data))
+		rootfs, err = testFS(textar.Parse(data))
+		if err != nil {
+			return fmt.Errorf("load %s: %v", filename, err)
+		}
 		add("noargs")
 		add("packages", "-dump_packages")
 
@@ -80,6 +85,25 @@ func dump(ctx context.Context) error {
 			add("multiaction1", "-install", "-remove")
 			add("multiaction2", "-install", "-trace")
 			add("multiaction3", "-remove", "-trace")
+			add("badsort", "-sort=bad")
+			add("nocycles", "-cycles")
+			add("tuiargs", "-tui", "fancyapp")
+			add("tuimocked", "-tui")
+			add("multiaction4", "-tui", "-remove")
+			add("dominators", "-dominators")
+			add("json", "-format=json")
+			add("jsontrim", "-format=json", "fancyapp")
+			add("jsonconfig", "-format=json", "-f=tricky_pkgtrim", "-dump_config")
+			add("jsonremove", "-format=json", "-remove", "-dryrun")
+			add("csv", "-format=csv")
+			add("csvtrim", "-format=csv", "fancyapp")
+			add("dot", "-format=dot")
+			add("jsongraph", "-format=json", "-graph", "fancylib")
+			add("csvgraph", "-format=csv", "-graph", "fancylib", "otherapp")
+			add("csvconfig", "-format=csv", "-dump_config")
+			add("badformat", "-format=xml")
+			add("badstale", "-stale=90")
+			add("stale", "-stale=90d")
 			add("install", "-install", "-dryrun", "-f=tricky_pkgtrim")
 			add("filteredpackages", "-dump_packages", "fancylib", "otherapp")
 			add("removeall", "-remove", "-dryrun")
@@ -94,6 +118,21 @@ func dump(ctx context.Context) error {
 			add("remove1", "-remove", "-dryrun", "-f=pkgtrim.config", "clang")
 			add("trimmed", "-f=pkgtrim.config")
 			add("trimmed2", "-f=pkgtrim.config", "gmp")
+			add("trimmedbyage", "-sort=age", "-f=pkgtrim.config")
+			add("columns", "-columns=unique,total,deps,installed,version,reason", "-units=auto", "-f=pkgtrim.config")
+			add("badcolumns", "-columns=unique,bad")
+			add("sharedwith", "-columns=unique,total,deps,sharedwith", "-f=pkgtrim.config")
+			add("units", "-units=KiB", "-f=pkgtrim.config", "gmp")
+			add("badunits", "-units=TB")
+			add("stale", "-stale=90d", "-f=pkgtrim.config")
+			add("owns", "-owns", "-f=pkgtrim.config", "/usr/lib/libgmp.so.10.5.0", "/usr/bin/lynx", "/usr/bin", "/usr/bin/nonexistent")
+			add("files", "-files", "gmp", "ldns")
+			add("unowned", "-unowned", "-f=pkgtrim.config")
+			add("unownedlib", "-unowned", "-f=pkgtrim.config", "/usr/lib")
+			add("why", "-why", "-f=pkgtrim.config", "gmp")
+			add("whyintentional", "-why", "-f=pkgtrim.config", "polkit")
+			add("whytoplevel", "-why", "-f=pkgtrim.config", "ldns")
+			add("whybad", "-why", "gmp", "ldns")
 			add("trim1", "clang")
 			add("trim2", "-f=pkgtrim.config", "odin") // should not have clang as a unique dependency because clang is in .pkgtrim
 			add("tracebad0", "-trace")
@@ -102,6 +141,97 @@ func dump(ctx context.Context) error {
 			add("tracebad3", "-trace", "gdb", "gmp", "gmp")
 			add("tracebadpkg", "-trace", "gdb", "gxx")
 			add("traceok", "-trace", "gdb", "gmp")
+			add("tracejson", "-format=json", "-trace", "gdb", "gmp")
+			add("tracecsv", "-format=csv", "-trace", "gdb", "gmp")
+			add("explicit", "-explicit", "-f=pkgtrim.config")
+			add("reconcile", "-reconcile", "-dryrun", "-f=pkgtrim.config")
+			add("install", "-install", "-dryrun", "-f=pkgtrim.config")
+			add("optdeps", "libpcap")
+			add("optdepsgraph", "-graph", "ldns")
+			add("optdepstrace", "-optdeps", "-trace", "ldns", "libpcap")
+			add("optdepstracejson", "-optdeps", "-format=json", "-trace", "ldns", "libpcap")
+			add("optdepstrimmed", "-optdeps", "-f=pkgtrim.config")
+			add("optdepsremove", "-optdeps", "-remove", "-dryrun", "-f=pkgtrim.config")
+			add("cycles", "-cycles")
+			add("cyclestrim", "freetype2")
+			add("dominators", "-dominators", "clang", "graphviz")
+			add("dominatorsbad", "-dominators", "nonexistent")
+			add("jsonpackages", "-format=json", "-dump_packages", "gmp", "ldns")
+			add("jsonstale", "-format=json", "-stale=90d", "-f=pkgtrim.config")
+			add("jsontrim", "-format=json", "-f=pkgtrim.config", "freetype2")
+			add("whatif", "-whatif=-clang,+llvm-libs", "-f=pkgtrim.config")
+			add("whatifnew", "-whatif=+gnuplot", "-f=pkgtrim.config")
+			add("whatifbad", "-whatif=-nonexistent", "-f=pkgtrim.config")
+			add("whatifbadedit", "-whatif=clang", "-f=pkgtrim.config")
+			add("jsonexplicit", "-format=json", "-explicit", "-f=pkgtrim.config")
+			add("jsonfiles", "-format=json", "-files", "ldns")
+			add("jsonowns", "-format=json", "-owns", "-f=pkgtrim.config", "/usr/lib/libgmp.so.10.5.0", "/usr/bin/nonexistent")
+			add("jsonwhy", "-format=json", "-why", "-f=pkgtrim.config", "gmp")
+			add("jsoncycles", "-format=json", "-cycles")
+			add("jsondominators", "-format=json", "-dominators", "clang")
+			add("jsonwhatif", "-format=json", "-whatif=-clang,+llvm-libs", "-f=pkgtrim.config")
+			add("csvwhy", "-format=csv", "-why", "gmp")
+		}
+		if testfile == "alpine" {
+			add("trimmed", "-f=pkgtrim.config")
+			add("trim1", "-f=pkgtrim.config", "curl")
+			add("remove", "-remove", "-dryrun", "-f=pkgtrim.config")
+			add("install", "-install", "-dryrun", "-f=pkgtrim.config")
+			add("explicit", "-explicit")
+			add("stale", "-stale=90d")
+			add("owns", "-owns", "/bin/busybox")
+		}
+		if testfile == "debian" {
+			add("filteredpackages", "-dump_packages", "dpkg", "libc6*", "skype*", "zlib1g*")
+			add("trimforeign", "skype:i386")
+			add("trimnative", "skype-launcher")
+			add("explicit", "-explicit", "-f=pkgtrim.config")
+			add("seed", "-seed", "-f=pkgtrim.config")
+			add("reconcile", "-reconcile", "-dryrun", "-f=pkgtrim.config")
+			add("optdeps", "python-apt")
+			add("install", "-install", "-dryrun", "-f=fresh.config")
+			add("why", "-why", "-f=pkgtrim.config", "liberror-perl")
+			add("cycles", "-cycles")
+			add("owns", "-owns", "-f=pkgtrim.config", "/bin/ls", "/usr/bin/cat", "/usr/lib/x86_64-linux-gnu/libz.so.1", "/lib")
+			add("files", "-files", "coreutils", "zlib1g")
+			add("unowned", "-unowned")
+			add("unownedbin", "-unowned", "/bin")
+		}
+		if testfile == "desktop" {
+			add("trimmed", "-f=pkgtrim.config")
+			add("trim1", "-f=pkgtrim.config", "flatpak:com.spotify.Client")
+			add("remove", "-remove", "-dryrun", "-f=pkgtrim.config")
+			add("removeall", "-remove", "-dryrun")
+			add("removemanager", "-remove", "-dryrun", "flatpak")
+			add("install", "-install", "-dryrun", "-f=pkgtrim.config")
+		}
+		if testfile == "fedora" {
+			add("trimmed", "-f=pkgtrim.config")
+			add("trim1", "-f=pkgtrim.config", "curl")
+			add("trim2", "glibc.i686")
+			add("removemultilib", "-remove", "-dryrun", "glibc.i686")
+			add("cycles", "-cycles")
+			add("remove", "-remove", "-dryrun", "-f=pkgtrim.config")
+		}
+		if testfile == "gentoo" {
+			add("trimmed", "-f=pkgtrim.config")
+			add("trim1", "-f=pkgtrim.config", "dev-lang/python:3.11")
+			add("trim2", "-f=pkgtrim.config", "dev-python/requests")
+			add("remove", "-remove", "-dryrun", "-f=pkgtrim.config")
+			add("remove1", "-remove", "-dryrun", "-f=pkgtrim.config", "dev-python/requests")
+			add("install", "-install", "-dryrun", "-f=pkgtrim.config")
+		}
+		if testfile == "openwrt" {
+			add("trimmed", "-f=pkgtrim.config")
+			add("trim1", "-f=pkgtrim.config", "tcpdump-mini")
+			add("explicit", "-explicit", "-f=pkgtrim.config")
+			add("remove", "-remove", "-dryrun", "-f=pkgtrim.config")
+			add("reconcile", "-reconcile", "-dryrun", "-f=pkgtrim.config")
+		}
+		if testfile == "void" {
+			add("trimmed", "-f=pkgtrim.config")
+			add("trim1", "-f=pkgtrim.config", "linux")
+			add("remove", "-remove", "-dryrun", "-f=pkgtrim.config")
 		}
 	}
 
@@ -1,6 +1,6 @@
 module github.com/ypsu/pkgtrim
 
-go 1.24
+go 1.25
 
 require (
 	github.com/ypsu/effdump v0.241228.0
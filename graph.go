@@ -0,0 +1,576 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// pkgid is the index of a package in depgraph.pkgs.
+// To keep things efficient, the graph algorithms work on integer arrays.
+type pkgid int32
+
+// depgraph is the dependency graph of the installed packages along with its cycles and dominator tree.
+// The reports are computed from it.
+type depgraph struct {
+	pkgs        []Package
+	n           int              // number of packages
+	toporder    []pkgid          // the topological order of the packages, built by traverse
+	visited     []bool           // marker for traverse
+	shared      []bool           // marker for determining the unique size
+	intentional []bool           // marker whether the package is intentional or not
+	deps        [][]pkgid        // direct dependencies of a package
+	rdeps       [][]pkgid        // direct reverse dependencies of a package
+	optdeps     [][]pkgid        // direct optional dependencies of a package, also part of deps if -optdeps
+	optrdeps    [][]pkgid        // direct optional reverse dependencies of a package, also part of rdeps if -optdeps
+	pkgids      map[string]pkgid // map package names to a number
+
+	scc  []int32   // the component of each package
+	sccs [][]pkgid // the sorted packages of each component
+
+	root     pkgid     // the virtual root of the dominator tree
+	rootdeps []pkgid   // the intentional and the top level packages, the root depends on them
+	domsize  []int64   // the total size of the dominator subtree of each package
+	children [][]pkgid // the children of each package in the dominator tree
+
+	rootwords int        // the length of the rootbits bitsets
+	rootbits  [][]uint64 // the bitsets of the roots depending on each package indexed by the position in rootdeps
+}
+
+// newDepgraph builds the dependency graph of pkgs, the packages matching intentionalRE are the intentional ones.
+// If optdeps is set then the optional dependencies are treated as dependencies.
+func newDepgraph(pkgs []Package, intentionalRE *regexp.Regexp, optdeps bool) *depgraph {
+	n := len(pkgs)
+	g := &depgraph{
+		pkgs:        pkgs,
+		n:           n,
+		toporder:    make([]pkgid, 0, n),
+		visited:     make([]bool, n),
+		shared:      make([]bool, n),
+		intentional: make([]bool, n),
+		deps:        make([][]pkgid, n),
+		rdeps:       make([][]pkgid, n),
+		optdeps:     make([][]pkgid, n),
+		optrdeps:    make([][]pkgid, n),
+		pkgids:      make(map[string]pkgid, n),
+	}
+
+	// Compute deps and rdeps.
+	for i, p := range pkgs {
+		g.pkgids[p.Name] = pkgid(i)
+	}
+	for i, p := range pkgs {
+		g.intentional[i] = intentionalRE.MatchString(p.Name)
+		g.deps[i] = make([]pkgid, len(p.Deps))
+		for j, d := range p.Deps {
+			g.deps[i][j] = g.pkgids[d]
+			g.rdeps[g.pkgids[d]] = append(g.rdeps[g.pkgids[d]], pkgid(i))
+		}
+		for _, d := range p.OptDeps {
+			g.optdeps[i] = append(g.optdeps[i], g.pkgids[d])
+			g.optrdeps[g.pkgids[d]] = append(g.optrdeps[g.pkgids[d]], pkgid(i))
+		}
+	}
+	if optdeps {
+		for i := range n {
+			g.deps[i] = append(g.deps[i], g.optdeps[i]...)
+			g.rdeps[i] = append(g.rdeps[i], g.optrdeps[i]...)
+		}
+	}
+
+	g.findCycles()
+	g.buildDominators()
+	g.buildRootbits()
+	return g
+}
+
+// findCycles finds the strongly connected components, i.e. the dependency cycles, with Tarjan's algorithm.
+// The components are numbered in reverse topological order: a component's dependencies have smaller numbers.
+func (g *depgraph) findCycles() {
+	var (
+		n       = g.n
+		index   = make([]int32, n) // the discovery order of the packages starting from 1, 0 if not discovered yet
+		lowlink = make([]int32, n) // the smallest index reachable from the package through the packages on the stack
+		onstack = make([]bool, n)
+		stack   = make([]pkgid, 0, n)
+		counter int32
+	)
+	g.scc, g.sccs = make([]int32, n), make([][]pkgid, 0, n)
+	var strongconnect func(pkgid)
+	strongconnect = func(u pkgid) {
+		counter++
+		index[u], lowlink[u] = counter, counter
+		stack, onstack[u] = append(stack, u), true
+		for _, v := range g.deps[u] {
+			if index[v] == 0 {
+				strongconnect(v)
+				lowlink[u] = min(lowlink[u], lowlink[v])
+			} else if onstack[v] {
+				lowlink[u] = min(lowlink[u], index[v])
+			}
+		}
+		if lowlink[u] != index[u] {
+			return
+		}
+		members := make([]pkgid, 0, 1)
+		for {
+			v := stack[len(stack)-1]
+			stack, onstack[v], g.scc[v] = stack[:len(stack)-1], false, int32(len(g.sccs))
+			members = append(members, v)
+			if v == u {
+				break
+			}
+		}
+		slices.Sort(members)
+		g.sccs = append(g.sccs, members)
+	}
+	for i := range n {
+		if index[i] == 0 {
+			strongconnect(pkgid(i))
+		}
+	}
+}
+
+// buildDominators computes the dominator tree with the Lengauer-Tarjan algorithm.
+// A virtual root depends on the intentional and the top level packages.
+// Package i dominates package j if all paths from the root to j go through i.
+// So the dominator subtree of a package is exactly the set of packages that only it keeps installed.
+func (g *depgraph) buildDominators() {
+	var (
+		n        = g.n
+		root     = pkgid(n)
+		idom     = make([]pkgid, n+1)    // the immediate dominator of each package
+		domsize  = make([]int64, n+1)    // the total size of the dominator subtree of each package
+		dfnum    = make([]int32, n+1)    // the preorder number of the packages starting from 1, 0 if not visited yet
+		vertex   = make([]pkgid, 1, n+2) // the packages in preorder, the inverse of dfnum
+		parent   = make([]pkgid, n+1)    // the parent in the depth first search tree
+		semi     = make([]int32, n+1)    // the preorder number of the semidominator
+		ancestor = make([]pkgid, n+1)    // the forest of the already processed packages, -1 for the roots
+		label    = make([]pkgid, n+1)    // the package with the smallest semidominator on the compressed path
+		bucket   = make([][]pkgid, n+1)  // the packages whose semidominator is the given package
+		preds    = make([][]pkgid, n+1)  // the reverse edges including the ones from the root
+		rootdeps = make([]pkgid, 0, n)
+	)
+	for i := range n {
+		if g.intentional[i] || !g.hasRdeps(pkgid(i)) {
+			rootdeps = append(rootdeps, pkgid(i))
+		}
+	}
+	var dfs func(pkgid, []pkgid)
+	dfs = func(u pkgid, succs []pkgid) {
+		dfnum[u], semi[u], label[u], ancestor[u] = int32(len(vertex)), int32(len(vertex)), u, -1
+		vertex = append(vertex, u)
+		for _, v := range succs {
+			preds[v] = append(preds[v], u)
+			if dfnum[v] == 0 {
+				parent[v] = u
+				dfs(v, g.deps[v])
+			}
+		}
+	}
+	dfs(root, rootdeps)
+	var compress func(pkgid)
+	compress = func(v pkgid) {
+		a := ancestor[v]
+		if ancestor[a] == -1 {
+			return
+		}
+		compress(a)
+		if semi[label[a]] < semi[label[v]] {
+			label[v] = label[a]
+		}
+		ancestor[v] = ancestor[a]
+	}
+	eval := func(v pkgid) pkgid {
+		if ancestor[v] == -1 {
+			return v
+		}
+		compress(v)
+		return label[v]
+	}
+	for i := len(vertex) - 1; i >= 2; i-- {
+		u := vertex[i]
+		for _, v := range preds[u] {
+			semi[u] = min(semi[u], semi[eval(v)])
+		}
+		bucket[vertex[semi[u]]] = append(bucket[vertex[semi[u]]], u)
+		p := parent[u]
+		ancestor[u] = p
+		for _, v := range bucket[p] {
+			if x := eval(v); semi[x] < semi[v] {
+				idom[v] = x
+			} else {
+				idom[v] = p
+			}
+		}
+		bucket[p] = nil
+	}
+	for _, u := range vertex[2:] {
+		if idom[u] != vertex[semi[u]] {
+			idom[u] = idom[idom[u]]
+		}
+	}
+	idom[root] = root
+	for i := len(vertex) - 1; i >= 2; i-- {
+		u := vertex[i]
+		domsize[u] += g.pkgs[u].Size
+		domsize[idom[u]] += domsize[u]
+	}
+
+	children := make([][]pkgid, n+1)
+	for _, u := range vertex[2:] {
+		children[idom[u]] = append(children[idom[u]], u)
+	}
+	for _, c := range children {
+		slices.SortFunc(c, func(a, b pkgid) int { return cmp.Or(cmp.Compare(domsize[a], domsize[b]), cmp.Compare(a, b)) })
+	}
+	g.root, g.rootdeps, g.domsize, g.children = root, rootdeps, domsize, children
+}
+
+// buildRootbits computes for each package the set of the dominator tree's roots (the intentional and the top level packages) that depend on it as a bitset.
+// The components are processed in topological order so the rdeps are ready before their dependencies.
+func (g *depgraph) buildRootbits() {
+	g.rootwords = (len(g.rootdeps) + 63) / 64
+	g.rootbits = make([][]uint64, g.n)
+	for c := len(g.sccs) - 1; c >= 0; c-- {
+		bits := make([]uint64, g.rootwords)
+		for _, i := range g.sccs[c] {
+			if r, found := slices.BinarySearch(g.rootdeps, i); found {
+				bits[r/64] |= 1 << (r % 64)
+			}
+			for _, j := range g.rdeps[i] {
+				if g.scc[j] != int32(c) {
+					for k := range bits {
+						bits[k] |= g.rootbits[j][k]
+					}
+				}
+			}
+		}
+		for _, i := range g.sccs[c] {
+			g.rootbits[i] = bits
+		}
+	}
+}
+
+// hasRdeps reports whether the package is the first package of its cycle and no package outside the cycle depends on it.
+// Such a package represents its whole cycle as a top level package.
+func (g *depgraph) hasRdeps(i pkgid) bool {
+	if g.sccs[g.scc[i]][0] != i {
+		return true
+	}
+	for _, j := range g.sccs[g.scc[i]] {
+		if slices.ContainsFunc(g.rdeps[j], func(k pkgid) bool { return g.scc[k] != g.scc[i] }) {
+			return true
+		}
+	}
+	return false
+}
+
+// toplevel reports whether the package is the representative of an unintentional top level package or cycle.
+func (g *depgraph) toplevel(i pkgid) bool {
+	return !g.hasRdeps(i) && !slices.ContainsFunc(g.sccs[g.scc[i]], func(j pkgid) bool { return g.intentional[j] })
+}
+
+// cycle returns the names of the packages in the cycle of the package, just the package's name if it isn't part of a cycle.
+func (g *depgraph) cycle(i pkgid) []string {
+	names := make([]string, 0, len(g.sccs[g.scc[i]]))
+	for _, j := range g.sccs[g.scc[i]] {
+		names = append(names, g.pkgs[j].Name)
+	}
+	return names
+}
+
+// dominated returns the dominator subtree of a package: the package, the rest of its cycle, and the dependencies only it keeps installed.
+func (g *depgraph) dominated(u pkgid) []pkgid {
+	subtree := []pkgid{u}
+	for _, c := range g.children[u] {
+		subtree = append(subtree, g.dominated(c)...)
+	}
+	return subtree
+}
+
+// traverse runs a depth first search from a given node along edges, either deps or rdeps, and builds toporder.
+func (g *depgraph) traverse(edges [][]pkgid, u pkgid) {
+	if g.visited[u] {
+		return
+	}
+	g.visited[u] = true
+	for _, v := range edges[u] {
+		g.traverse(edges, v)
+	}
+	g.toporder = append(g.toporder, u)
+}
+
+// reset clears the markers of the packages traverse and computeUnique visited.
+func (g *depgraph) reset() {
+	for _, i := range g.toporder {
+		g.visited[i], g.shared[i] = false, false
+	}
+	g.toporder = g.toporder[:0]
+}
+
+// computeUnique computes the shared array and returns the unique size.
+// Should be called after traverse().
+func (g *depgraph) computeUnique(seed ...pkgid) int64 {
+	// A package is not unique in the ith package if it has an rdep that is already shared or is outside the visited packages.
+	// The packages of a cycle are decided together: they are shared if any of them is shared.
+	// Sorting by the components in decreasing order makes sure the rdeps are decided before the package.
+	slices.SortStableFunc(g.toporder, func(a, b pkgid) int { return cmp.Compare(g.scc[b], g.scc[a]) })
+	var uniqueSize int64
+	for start := 0; start < len(g.toporder); {
+		end, cycleShared := start, false
+		for ; end < len(g.toporder) && g.scc[g.toporder[end]] == g.scc[g.toporder[start]]; end++ {
+			i := g.toporder[end]
+			if slices.Contains(seed, i) {
+				continue
+			}
+			for _, j := range g.rdeps[i] {
+				if g.scc[j] != g.scc[i] && (g.shared[j] || !g.visited[j]) || g.intentional[i] {
+					cycleShared = true
+					break
+				}
+			}
+		}
+		for _, i := range g.toporder[start:end] {
+			if slices.Contains(seed, i) || !cycleShared {
+				uniqueSize += g.pkgs[i].Size
+			} else {
+				g.shared[i] = true
+			}
+		}
+		start = end
+	}
+	return uniqueSize
+}
+
+// sharedWith returns the number of roots outside of the visited packages that share some of the visited packages.
+// Should be called after traverse().
+func (g *depgraph) sharedWith() int {
+	union := make([]uint64, g.rootwords)
+	for _, i := range g.toporder {
+		for k := range union {
+			union[k] |= g.rootbits[i][k]
+		}
+	}
+	cnt := 0
+	for r, i := range g.rootdeps {
+		if union[r/64]>>(r%64)&1 == 1 && !g.visited[i] {
+			cnt++
+		}
+	}
+	return cnt
+}
+
+// unique returns the sorted names of seed and of the dependencies only seed keeps installed.
+func (g *depgraph) unique(seed []pkgid) []string {
+	for _, i := range seed {
+		g.traverse(g.deps, i)
+	}
+	g.computeUnique(seed...)
+	names := make([]string, 0, 64)
+	for _, i := range g.toporder {
+		if !g.shared[i] {
+			names = append(names, g.pkgs[i].Name)
+		}
+	}
+	g.reset()
+	slices.Sort(names)
+	return names
+}
+
+// topLevel returns the entries of the no args listing: the unintentional top level packages and cycles.
+// Their unique size is the size of their dominator subtree.
+// The entries are ordered by size or with byAge from the unknown install dates through the newest to the oldest.
+// If stale isn't nil then only the entries it keeps are listed, along with the time they were last used.
+func (g *depgraph) topLevel(byAge bool, stale func(pkgid) (lastused time.Time, keep bool, err error)) ([]TopLevelEntry, error) {
+	order := make([]pkgid, g.n)
+	for i := range g.n {
+		order[i] = pkgid(i)
+	}
+	slices.SortFunc(order, func(a, b pkgid) int {
+		return cmp.Compare(g.domsize[a], g.domsize[b])
+	})
+	if byAge {
+		// The packages with unknown install date come first, then from the newest to the oldest.
+		slices.SortStableFunc(order, func(a, b pkgid) int {
+			da, db := g.pkgs[a].InstallDate, g.pkgs[b].InstallDate
+			return cmp.Or(cmp.Compare(tonumber(!da.IsZero()), tonumber(!db.IsZero())), db.Compare(da))
+		})
+	}
+
+	entries := make([]TopLevelEntry, 0, 64)
+	for _, id := range order {
+		pkg := g.pkgs[id]
+		if !g.toplevel(id) {
+			continue
+		}
+		var lastused time.Time
+		if stale != nil {
+			last, keep, err := stale(id)
+			if err != nil {
+				return nil, err
+			}
+			if !keep {
+				continue
+			}
+			lastused = last
+		}
+		members := g.cycle(id)
+		var total int64
+		g.traverse(g.deps, id)
+		sharedwith := g.sharedWith()
+		for _, j := range g.toporder {
+			total += g.pkgs[j].Size
+		}
+		deps := len(g.toporder) - len(members)
+		g.reset()
+		entries = append(entries, TopLevelEntry{pkg.Name, members, pkg.Desc, g.domsize[id], pkg.InstallDate, lastused, pkg.Foreign, total, deps, pkg.Version, pkg.Reason, sharedwith})
+	}
+	return entries, nil
+}
+
+// dependencies returns the report of the dependencies of seed.
+func (g *depgraph) dependencies(seed []pkgid) DependencyReport {
+	for _, id := range seed {
+		g.traverse(g.deps, id)
+	}
+	sharedwith := g.sharedWith()
+	g.computeUnique(seed...)
+	report := DependencyReport{
+		SharedWith:         sharedwith,
+		Shared:             PackageSet{Packages: make([]string, 0, g.n)},
+		Unique:             PackageSet{Packages: make([]string, 0, g.n)},
+		IntentionalRdeps:   make([]string, 0, g.n),
+		UnintentionalRdeps: make([]string, 0, g.n),
+		OptionallyUsedBy:   make([]string, 0, g.n),
+	}
+	for i, pkg := range g.pkgs {
+		if g.shared[i] {
+			report.Shared.Size += pkg.Size
+			report.Shared.Packages = append(report.Shared.Packages, pkg.Name)
+		} else if g.visited[i] {
+			report.Unique.Size += pkg.Size
+			report.Unique.Packages = append(report.Unique.Packages, pkg.Name)
+		}
+	}
+	for i := range g.pkgs {
+		if g.visited[i] && !g.shared[i] {
+			for _, j := range g.optrdeps[i] {
+				if !g.visited[j] || g.shared[j] {
+					report.OptionallyUsedBy = append(report.OptionallyUsedBy, g.pkgs[j].Name)
+				}
+			}
+		}
+	}
+	g.reset()
+	slices.Sort(report.OptionallyUsedBy)
+	report.OptionallyUsedBy = slices.Compact(report.OptionallyUsedBy)
+
+	// Compute top level rdeps by running bfs in reverse.
+	for _, i := range seed {
+		g.traverse(g.rdeps, i)
+	}
+	for i := range g.pkgs {
+		if !g.visited[i] || g.hasRdeps(pkgid(i)) {
+			continue
+		}
+		if !g.toplevel(pkgid(i)) {
+			report.IntentionalRdeps = append(report.IntentionalRdeps, strings.Join(g.cycle(pkgid(i)), ","))
+		} else {
+			report.UnintentionalRdeps = append(report.UnintentionalRdeps, strings.Join(g.cycle(pkgid(i)), ","))
+		}
+	}
+	g.reset()
+	return report
+}
+
+// trace returns the dependency chains from src to dst.
+func (g *depgraph) trace(src, dst pkgid) (TraceResult, error) {
+	g.traverse(g.deps, src)
+	defer g.reset()
+	if !g.visited[dst] {
+		return TraceResult{}, fmt.Errorf("package %s is not a dependency of %s", g.pkgs[dst].Name, g.pkgs[src].Name)
+	}
+	trace := TraceResult{Src: g.pkgs[src].Name, Dst: g.pkgs[dst].Name, Paths: [][]string{}, OptionalEdges: [][2]string{}}
+	path := make([]pkgid, 0, 64)
+	var findpaths func(pkgid)
+	findpaths = func(pkg pkgid) {
+		if pkg == src {
+			// path is reversed: it goes from dst to src.
+			names := make([]string, 0, len(path))
+			for k := len(path) - 1; k >= 0; k-- {
+				names = append(names, g.pkgs[path[k]].Name)
+				if k >= 1 && slices.Contains(g.optdeps[path[k]], path[k-1]) {
+					edge := [2]string{g.pkgs[path[k]].Name, g.pkgs[path[k-1]].Name}
+					if !slices.Contains(trace.OptionalEdges, edge) {
+						trace.OptionalEdges = append(trace.OptionalEdges, edge)
+					}
+				}
+			}
+			trace.Paths = append(trace.Paths, names)
+			return
+		}
+		for _, rdep := range g.rdeps[pkg] {
+			// Skip the cycles, -optdeps makes them common.
+			if g.visited[rdep] && !slices.Contains(path, rdep) {
+				path = append(path, rdep)
+				findpaths(rdep)
+				path = path[:len(path)-1]
+			}
+		}
+	}
+	path = append(path, dst)
+	findpaths(dst)
+	return trace, nil
+}
+
+// graph returns the dependency graph of pkgs: the edges of their dependencies and of their reverse dependencies.
+// The optional dependencies are part of the graph even without -optdeps.
+func (g *depgraph) graph(pkgs []pkgid) DependencyGraph {
+	graph := DependencyGraph{Packages: make([]string, 0, len(pkgs)), Edges: [][2]string{}, OptionalEdges: [][2]string{}}
+	seen := map[[2]pkgid]bool{}
+	addEdge := func(from, to pkgid) {
+		if seen[[2]pkgid{from, to}] {
+			return
+		}
+		seen[[2]pkgid{from, to}] = true
+		edge := [2]string{g.pkgs[from].Name, g.pkgs[to].Name}
+		graph.Edges = append(graph.Edges, edge)
+		if slices.Contains(g.optdeps[from], to) {
+			graph.OptionalEdges = append(graph.OptionalEdges, edge)
+		}
+	}
+	for _, id := range pkgs {
+		graph.Packages = append(graph.Packages, g.pkgs[id].Name)
+		g.traverse(g.deps, id)
+	}
+	for i := range g.n {
+		if g.visited[i] {
+			for _, j := range g.deps[i] {
+				addEdge(pkgid(i), j)
+			}
+			for _, j := range g.optdeps[i] {
+				addEdge(pkgid(i), j)
+			}
+		}
+	}
+	g.reset()
+	for _, id := range pkgs {
+		g.traverse(g.rdeps, id)
+	}
+	for i := range g.n {
+		if g.visited[i] {
+			for _, j := range g.rdeps[i] {
+				addEdge(j, pkgid(i))
+			}
+			for _, j := range g.optrdeps[i] {
+				addEdge(j, pkgid(i))
+			}
+		}
+	}
+	g.reset()
+	return graph
+}
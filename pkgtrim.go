@@ -1,8 +1,11 @@
 package main
 
 import (
+	"archive/tar"
 	"bytes"
 	"cmp"
+	"compress/gzip"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -13,13 +16,36 @@ import (
 	"path/filepath"
 	"regexp"
 	"slices"
+	"strconv"
 	"strings"
+	"testing/fstest"
+	"time"
 
 	"github.com/ypsu/textar"
 )
 
-func humanize(sz int64) string {
-	return fmt.Sprintf("%7.1f MB", float64(sz)/1e6)
+// sizeUnits are the units formatSize accepts besides auto.
+var sizeUnits = map[string]float64{"B": 1, "KiB": 1 << 10, "MiB": 1 << 20, "GiB": 1 << 30, "MB": 1e6, "GB": 1e9}
+
+// formatSize formats sz in the given unit.
+// auto picks the largest binary unit under the size so its output is padded to keep the columns aligned.
+func formatSize(sz int64, unit string) string {
+	if unit == "auto" {
+		unit = "B"
+		for _, u := range []string{"KiB", "MiB", "GiB"} {
+			if float64(max(sz, -sz)) >= sizeUnits[u] {
+				unit = u
+			}
+		}
+		if unit == "B" {
+			return fmt.Sprintf("%7d B  ", sz)
+		}
+		return fmt.Sprintf("%7.1f %s", float64(sz)/sizeUnits[unit], unit)
+	}
+	if unit == "B" {
+		return fmt.Sprintf("%10d B", sz)
+	}
+	return fmt.Sprintf("%7.1f %s", float64(sz)/sizeUnits[unit], unit)
 }
 
 func getwd() string {
@@ -32,6 +58,9 @@ func getwd() string {
 
 var wd = getwd()
 
+// now returns the current time, dump.go fixes it so that the -stale output doesn't change over time.
+var now = time.Now
+
 // abspath makes a path into an absolute path.
 // The leading / is removed so that it can be used with fs.FS.
 func abspath(p string) string {
@@ -41,10 +70,99 @@ func abspath(p string) string {
 	return filepath.Join(wd, p)[1:]
 }
 
-func parseconfig(found map[string]struct{}, depth int, cfg []byte) error {
+// resolveDir resolves the symlinks in dir such as /bin -> usr/bin on the usrmerged systems.
+// resolved caches the results because the file lists share most of their directories.
+func resolveDir(rootfs fs.FS, resolved map[string]string, dir string, depth int) string {
+	if dir == "." || depth > 40 {
+		return dir
+	}
+	if r, ok := resolved[dir]; ok {
+		return r
+	}
+	r := filepath.Join(resolveDir(rootfs, resolved, filepath.Dir(dir), depth), filepath.Base(dir))
+	if target, err := fs.ReadLink(rootfs, r); err == nil {
+		if strings.HasPrefix(target, "/") {
+			target = filepath.Clean(target[1:])
+		} else {
+			target = filepath.Join(filepath.Dir(r), target)
+		}
+		r = resolveDir(rootfs, resolved, target, depth+1)
+	}
+	resolved[dir] = r
+	return r
+}
+
+// canonicalPath resolves the symlinks in the directories of file so that /bin/ls and /usr/bin/ls are the same file on the usrmerged systems.
+// The file itself isn't resolved because the packages own the symlinks, not their targets.
+func canonicalPath(rootfs fs.FS, resolved map[string]string, file string) string {
+	return filepath.Join(resolveDir(rootfs, resolved, filepath.Dir(file), 0), filepath.Base(file))
+}
+
+// testFS returns the filesystem of a textar archive for -testfs.
+// textar can't hold symlinks so the "/bin -> usr/bin" style names are turned into symlinks.
+func testFS(archive []textar.File) (fstest.MapFS, error) {
+	archive, err := packSyncDBs(archive)
+	if err != nil {
+		return nil, err
+	}
+	fsys := textar.FS(archive)
+	for name := range fsys {
+		if link, target, ok := strings.Cut(name, " -> "); ok {
+			delete(fsys, name)
+			fsys[link] = &fstest.MapFile{Data: []byte(target), Mode: fs.ModeSymlink | 0777}
+		}
+	}
+	return fsys, nil
+}
+
+// packSyncDBs packs the /var/lib/pacman/sync/*.db/ directories into gzipped tarballs like pacman's sync databases.
+// textar can't hold binary files so the testdata stores the databases unpacked.
+func packSyncDBs(files []textar.File) ([]textar.File, error) {
+	var (
+		packed   = make([]textar.File, 0, len(files))
+		dbnames  []string
+		dbs      = map[string]*bytes.Buffer{}
+		tarballs = map[string]*tar.Writer{}
+	)
+	for _, f := range files {
+		db, entry, ok := strings.Cut(f.Name, ".db/")
+		if !ok || !strings.HasPrefix(f.Name, "/var/lib/pacman/sync/") {
+			packed = append(packed, f)
+			continue
+		}
+		if _, exists := dbs[db]; !exists {
+			dbnames, dbs[db] = append(dbnames, db), &bytes.Buffer{}
+			tarballs[db] = tar.NewWriter(dbs[db])
+		}
+		if err := tarballs[db].WriteHeader(&tar.Header{Name: entry, Mode: 0644, Size: int64(len(f.Data))}); err != nil {
+			return nil, err
+		}
+		if _, err := tarballs[db].Write(f.Data); err != nil {
+			return nil, err
+		}
+	}
+	for _, db := range dbnames {
+		if err := tarballs[db].Close(); err != nil {
+			return nil, err
+		}
+		gzipped := &bytes.Buffer{}
+		gz := gzip.NewWriter(gzipped)
+		gz.Write(dbs[db].Bytes())
+		if err := gz.Close(); err != nil {
+			return nil, err
+		}
+		packed = append(packed, textar.File{Name: db + ".db", Data: gzipped.Bytes()})
+	}
+	return packed, nil
+}
+
+// parseconfig collects the entries of the config into found along with their comments.
+// The entries without a comment get the comment of the section, i.e. the comment line above them.
+func parseconfig(found map[string]string, depth int, cfg []byte) error {
 	if depth > 10 {
 		return fmt.Errorf("too many nested commands")
 	}
+	section := ""
 	for i, line := range strings.Split(string(cfg), "\n") {
 		if strings.HasPrefix(line, "!") {
 			output, err := exec.Command("sh", "-c", line[1:]).Output()
@@ -59,9 +177,15 @@ func parseconfig(found map[string]struct{}, depth int, cfg []byte) error {
 			}
 			continue
 		}
-		pkgs, _, _ := strings.Cut(line, "#") // strip comments
+		pkgs, comment, _ := strings.Cut(line, "#") // strip comments
+		comment = strings.TrimSpace(comment)
+		if strings.TrimSpace(pkgs) == "" {
+			section = comment
+		}
 		for _, pkg := range strings.Fields(pkgs) {
-			found[pkg] = struct{}{}
+			if found[pkg] == "" {
+				found[pkg] = cmp.Or(comment, section)
+			}
 		}
 	}
 	return nil
@@ -85,6 +209,35 @@ func makeRE(globs ...string) *regexp.Regexp {
 	return regexp.MustCompile(expr.String())
 }
 
+// run prints the commands and then runs them one after the other unless dryrun is set.
+func run(w io.Writer, cmds [][]string, dryrun bool) error {
+	for _, argv := range cmds {
+		fmt.Fprintln(w, strings.Join(argv, " "))
+	}
+	if dryrun {
+		return nil
+	}
+	fmt.Fprintln(w)
+	for _, argv := range cmds {
+		cmd := exec.Command(argv[0], argv[1:]...)
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("run %s: %v", argv[0], err)
+		}
+	}
+	return nil
+}
+
+// formatDate formats the date part of t in UTC or returns "-" for the zero time.
+func formatDate(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.UTC().Format(time.DateOnly)
+}
+
 func tonumber(v bool) int {
 	if v {
 		return 1
@@ -110,15 +263,32 @@ func Pkgtrim(w io.Writer, rootfs fs.FS, args []string) error {
 	defaultTrimfile := filepath.Join(os.Getenv("HOME"), ".pkgtrim")
 	var (
 		flagset          = flag.NewFlagSet("pkgtrim", flag.ContinueOnError)
-		flagDryrun       = flagset.Bool("dryrun", false, "Don't execute the -remove or -install commands.")
+		flagCycles       = flagset.Bool("cycles", false, "List the dependency cycles, i.e. the packages that depend on each other. pkgtrim handles each cycle as a single package.")
+		flagDominators   = flagset.Bool("dominators", false, "Print the dominator tree of the top level and intentional packages or of the given packages: the packages under a package are the ones that only it keeps installed.")
+		flagDryrun       = flagset.Bool("dryrun", false, "Don't execute the -remove, -install, or -reconcile commands.")
 		flagDumpConfig   = flagset.Bool("dump_config", false, "Debug option: if true then dump the parsed config.")
 		flagDumpPackages = flagset.Bool("dump_packages", false, "Debug option: if true then dump the list of packages pkgtrim detected. Filter to specific packages via arguments.")
+		flagExplicit     = flagset.Bool("explicit", false, "Compare the packages the package manager considers explicitly installed with the intentional packages.")
+		flagFormat       = flagset.String("format", "text", "The output format: text, json, csv, or dot. csv works only with the listings, -trace, and -graph, dot only with -trace and -graph. -install, -remove, -seed, -reconcile, and -tui support only text. See the README for the schemas.")
+		flagFiles        = flagset.Bool("files", false, "List the files of the argument packages along with their sizes.")
 		flagGraph        = flagset.Bool("graph", false, "Show the dependency graph of the arguments. Pipe the output to 'dot -Tx11' to visualize the graph.")
+		flagOptdeps      = flagset.Bool("optdeps", false, "Treat the optional dependencies as dependencies. Then the optional dependencies of the kept packages are kept by -remove too.")
+		flagWhy          = flagset.Bool("why", false, "Show the shortest dependency chains from the intentional packages or from the unintentional top level packages to the argument package.")
 		flagInstall      = flagset.Bool("install", false, "Install the packages specified in .pkgtrim.")
+		flagReconcile    = flagset.Bool("reconcile", false, "Mark the intentional packages as explicitly installed and the rest as dependencies in the package manager's database.")
+		flagStale        = flagset.String("stale", "", "List only the unintentional packages installed and last used more than this many days ago, e.g. 90d. Uses the access times of the packages' files.")
+		flagSort         = flagset.String("sort", "size", "The order of the unintentional packages: size (the biggest at the bottom) or age (the oldest at the bottom).")
+		flagOwns         = flagset.Bool("owns", false, "Show which package owns each argument file and which intentional packages keep that package installed.")
+		flagUnowned      = flagset.Bool("unowned", false, "List the files and directories no package owns under the argument directories or under /etc, /opt, and /usr if no arguments. Entries in .pkgtrim starting with / are globs of paths to ignore.")
 		flagRemove       = flagset.Bool("remove", false, "Remove the selected packages and their unique dependencies or all unintentional packages and their dependencies if no arguments.")
+		flagSeed         = flagset.Bool("seed", false, "Print the explicitly installed but unintentional packages in .pkgtrim format. Useful for seeding .pkgtrim from the package manager's database.")
 		flagTestFS       = flagset.String("testfs", "", "Mock the filesystem with this textar file instead of using the real filesystem.")
 		flagTrace        = flagset.Bool("trace", false, "If true, there must be two arguments, [package] and [dependency] and pkgtrim generates a dependency graph between the two. Pipe the output to 'dot -Tx11' to visualize the graph.")
+		flagTui          = flagset.Bool("tui", false, "Interactively mark the unintentional top level packages for removal or for appending to .pkgtrim, then remove and append them after a confirmation.")
+		flagUnits        = flagset.String("units", "MB", "The unit of the sizes: auto, B, KiB, MiB, GiB, MB, or GB. auto picks the best binary unit for each size.")
+		flagColumns      = flagset.String("columns", "", "The comma separated columns of the listing before the name and the description: "+strings.Join(listingColumns, ", ")+". The default is unique and total followed by the columns -sort and -stale need and the foreign column if the package system tracks it.")
 		flagTrimfile     = flagset.String("f", defaultTrimfile, "The config file.")
+		flagWhatif       = flagset.String("whatif", "", "Simulate .pkgtrim edits such as -clang,+llvm (remove the clang entry, add llvm) and print which packages they would orphan. Doesn't modify .pkgtrim.")
 	)
 	flagset.SetOutput(w)
 	flagset.Usage = func() {
@@ -130,16 +300,48 @@ func Pkgtrim(w io.Writer, rootfs fs.FS, args []string) error {
 		return err
 	}
 
-	if tonumber(*flagInstall)+tonumber(*flagRemove)+tonumber(*flagTrace) >= 2 {
+	actions := tonumber(*flagInstall) + tonumber(*flagRemove) + tonumber(*flagTrace) + tonumber(*flagExplicit) + tonumber(*flagSeed) + tonumber(*flagReconcile) + tonumber(*flagOwns) + tonumber(*flagFiles) + tonumber(*flagUnowned) + tonumber(*flagWhy) + tonumber(*flagCycles) + tonumber(*flagDominators) + tonumber(*flagWhatif != "") + tonumber(*flagTui)
+	if actions >= 2 {
 		return fmt.Errorf("only one action allowed")
 	}
 
+	if _, ok := sizeUnits[*flagUnits]; !ok && *flagUnits != "auto" {
+		return fmt.Errorf("invalid -units=%s, want auto, B, KiB, MiB, GiB, MB, or GB", *flagUnits)
+	}
+
+	if *flagTui && flagset.NArg() > 0 {
+		return fmt.Errorf("-tui doesn't take arguments")
+	}
+
+	if *flagSort != "size" && *flagSort != "age" {
+		return fmt.Errorf("invalid -sort=%s, want size or age", *flagSort)
+	}
+
+	var staleDays int
+	if *flagStale != "" {
+		days, ok := strings.CutSuffix(*flagStale, "d")
+		n, err := strconv.Atoi(days)
+		if !ok || err != nil || n < 0 {
+			return fmt.Errorf("invalid -stale=%s, want a number of days such as 90d", *flagStale)
+		}
+		staleDays = n
+		if *flagRemove {
+			return fmt.Errorf("-stale can't be combined with -remove")
+		}
+	}
+
 	if *flagTestFS != "" {
 		data, err := fs.ReadFile(rootfs, abspath(*flagTestFS))
 		if err != nil {
 			return fmt.Errorf("load testfs: %v", err)
 		}
-		rootfs = textar.FS(textar.Parse(data))
+		if rootfs, err = testFS(textar.Parse(data)); err != nil {
+			return fmt.Errorf("load testfs: %v", err)
+		}
+	}
+	// -tui appends to the real .pkgtrim and removes the real packages so don't let it act on a mocked filesystem.
+	if *flagTui && !*flagDryrun && rootfs != os.DirFS("/") {
+		return fmt.Errorf("-tui requires -dryrun on a mocked filesystem such as -testfs")
 	}
 
 	system, err := NewPackageSystem(rootfs)
@@ -152,21 +354,60 @@ func Pkgtrim(w io.Writer, rootfs fs.FS, args []string) error {
 	}
 	slices.SortFunc(pkgs, func(a, b Package) int { return cmp.Compare(a.Name, b.Name) })
 
+	columns := []string{"unique", "total"}
+	if *flagColumns != "" {
+		columns = strings.Split(*flagColumns, ",")
+		for _, column := range columns {
+			if !slices.Contains(listingColumns, column) {
+				return fmt.Errorf("invalid column %q in -columns, want one of %s", column, strings.Join(listingColumns, ", "))
+			}
+		}
+	} else {
+		if *flagStale != "" {
+			columns = append(columns, "installed", "lastused")
+		} else if *flagSort == "age" {
+			columns = append(columns, "installed")
+		}
+		// Show the foreign column only if the package system tracks foreign packages.
+		if slices.ContainsFunc(pkgs, func(p Package) bool { return p.Foreign }) {
+			columns = append(columns, "foreign")
+		}
+	}
+	renderer, err := NewRenderer(*flagFormat, textRenderer{*flagUnits, columns, *flagStale != ""})
+	if err != nil {
+		return err
+	}
+	// The queries and the dumps print their reports directly, they support only text and JSON.
+	queries := tonumber(*flagExplicit) + tonumber(*flagOwns) + tonumber(*flagFiles) + tonumber(*flagUnowned) + tonumber(*flagWhy) + tonumber(*flagCycles) + tonumber(*flagDominators) + tonumber(*flagWhatif != "")
+	if *flagFormat != "text" && actions-tonumber(*flagTrace)-queries > 0 {
+		return fmt.Errorf("-install, -remove, -seed, -reconcile, and -tui support only -format=text")
+	}
+	if *flagFormat != "text" && *flagFormat != "json" && (queries > 0 || *flagDumpPackages || *flagDumpConfig) {
+		return fmt.Errorf("-format=%s works only with the listings, -trace, and -graph, the other modes support only -format=text and -format=json", *flagFormat)
+	}
+
 	if *flagDumpPackages {
 		filter := regexp.MustCompile(".*")
 		if flagset.NArg() > 0 {
 			filter = makeRE(flagset.Args()...)
 		}
+		if *flagFormat == "json" {
+			return writeJSON(w, slices.DeleteFunc(pkgs, func(pkg Package) bool { return !filter.MatchString(pkg.Name) }))
+		}
 		for _, pkg := range pkgs {
 			if filter.MatchString(pkg.Name) {
-				fmt.Fprintf(w, "%s %d %s\n", pkg.Name, pkg.Size, strings.Join(pkg.Deps, " "))
+				packager := "-"
+				if pkg.Packager != "" {
+					packager = strconv.Quote(pkg.Packager)
+				}
+				fmt.Fprintf(w, "%s %s %s %d %s %s %s %s\n", pkg.Name, cmp.Or(pkg.Version, "-"), cmp.Or(pkg.Arch, "-"), pkg.Size, formatDate(pkg.InstallDate), formatDate(pkg.BuildDate), packager, strings.Join(pkg.Deps, " "))
 			}
 		}
 		return nil
 	}
 
 	// Parse ~/.pkgtrim.
-	foundPackages := map[string]struct{}{}
+	foundPackages := map[string]string{}
 	trimfileBytes, err := fs.ReadFile(rootfs, abspath(*flagTrimfile))
 	if err != nil {
 		if *flagTrimfile != defaultTrimfile {
@@ -176,53 +417,333 @@ func Pkgtrim(w io.Writer, rootfs fs.FS, args []string) error {
 	if err := parseconfig(foundPackages, 0, trimfileBytes); err != nil {
 		return fmt.Errorf("parse %s: %v", *flagTrimfile, err)
 	}
+	if *flagDumpConfig && *flagFormat == "json" {
+		entries := make([]configEntry, 0, len(foundPackages))
+		for _, entry := range slices.Sorted(maps.Keys(foundPackages)) {
+			entries = append(entries, configEntry{entry, foundPackages[entry]})
+		}
+		return writeJSON(w, entries)
+	}
 	if *flagDumpConfig {
 		fmt.Fprintln(w, strings.Join(slices.Sorted(maps.Keys(foundPackages)), "\n"))
 		return nil
 	}
+
+	// The entries starting with / are the globs of the paths -unowned should ignore, not packages.
+	ignoredPaths := make([]string, 0, 16)
+	for entry := range foundPackages {
+		if strings.HasPrefix(entry, "/") {
+			ignoredPaths = append(ignoredPaths, entry)
+			delete(foundPackages, entry)
+		}
+	}
 	intentionalRE := makeRE(slices.Collect(maps.Keys(foundPackages))...)
 
-	// To keep things efficient, keep things in integer arrays.
-	type pkgid int32
-	var (
-		n           = len(pkgs)                 // number of packages
-		toporder    = make([]pkgid, 0, n)       // the topological order of the packages, built by traverse
-		visited     = make([]bool, n)           // marker for traverse
-		shared      = make([]bool, n)           // marker for determining the unique size
-		intentional = make([]bool, n)           // marker whether the package is intentional or not
-		deps        = make([][]pkgid, n)        // direct dependencies of a package
-		rdeps       = make([][]pkgid, n)        // direct reverse dependencies of a package
-		pkgids      = make(map[string]pkgid, n) // map package names to a number
-		unique      = make([]int64, n)          // the total unique size used for each package
-	)
+	// Apply the -whatif edits to a copy of the config.
+	var whatifRE *regexp.Regexp
+	if *flagWhatif != "" {
+		if flagset.NArg() > 0 {
+			return fmt.Errorf("-whatif doesn't take arguments")
+		}
+		edited := maps.Clone(foundPackages)
+		for _, edit := range strings.Split(*flagWhatif, ",") {
+			switch {
+			case strings.HasPrefix(edit, "+") && len(edit) > 1:
+				edited[edit[1:]] = ""
+			case strings.HasPrefix(edit, "-") && len(edit) > 1:
+				if _, exists := edited[edit[1:]]; !exists {
+					return fmt.Errorf("-whatif: %s is not in %s", edit[1:], *flagTrimfile)
+				}
+				delete(edited, edit[1:])
+			default:
+				return fmt.Errorf("invalid -whatif edit %q, want +entry or -entry", edit)
+			}
+		}
+		whatifRE = makeRE(slices.Collect(maps.Keys(edited))...)
+	}
 
-	// Compute deps and rdeps.
-	for i, p := range pkgs {
-		pkgids[p.Name] = pkgid(i)
+	g := newDepgraph(pkgs, intentionalRE, *flagOptdeps)
+
+	if *flagExplicit || *flagSeed || *flagReconcile {
+		if !slices.ContainsFunc(pkgs, func(p Package) bool { return p.Reason != ReasonUnknown }) {
+			return fmt.Errorf("the package system doesn't track the explicitly installed packages")
+		}
+		var (
+			explicitpkgs = make([]string, 0, g.n) // explicitly installed but unintentional packages
+			depspkgs     = make([]string, 0, g.n) // intentional packages installed as dependencies
+		)
+		for i, pkg := range pkgs {
+			if pkg.Reason == ReasonExplicit && !g.intentional[i] {
+				explicitpkgs = append(explicitpkgs, pkg.Name)
+				if *flagSeed {
+					fmt.Fprintf(w, "%-24s # %s\n", pkg.Name, pkg.Desc)
+				}
+			}
+			if pkg.Reason == ReasonDependency && g.intentional[i] {
+				depspkgs = append(depspkgs, pkg.Name)
+			}
+		}
+		if *flagSeed {
+			return nil
+		}
+		if *flagReconcile {
+			if len(explicitpkgs)+len(depspkgs) == 0 {
+				fmt.Fprintln(w, "Nothing to reconcile.")
+				return nil
+			}
+			var cmds [][]string
+			if marker, ok := system.(Marker); ok {
+				cmds = marker.Mark(depspkgs, explicitpkgs)
+			}
+			if len(cmds) == 0 {
+				return fmt.Errorf("the package system doesn't support changing the install reason")
+			}
+			if err := run(w, cmds, *flagDryrun); err != nil {
+				return fmt.Errorf("reconcile packages: %v", err)
+			}
+			return nil
+		}
+		if *flagFormat == "json" {
+			return writeJSON(w, ExplicitReport{explicitpkgs, depspkgs})
+		}
+		fmt.Fprintf(w, "explicitly installed unintentional packages: %s\n\n", strings.Join(explicitpkgs, " "))
+		fmt.Fprintf(w, "intentional packages installed as dependencies: %s\n\n", strings.Join(depspkgs, " "))
+		return nil
 	}
-	for i, p := range pkgs {
-		intentional[i] = intentionalRE.MatchString(p.Name)
-		deps[i] = make([]pkgid, len(p.Deps))
-		for j, d := range p.Deps {
-			deps[i][j] = pkgids[d]
-			rdeps[pkgids[d]] = append(rdeps[pkgids[d]], pkgid(i))
+
+	if *flagOwns || *flagFiles || *flagUnowned {
+		lister, ok := system.(FileLister)
+		if !ok {
+			return fmt.Errorf("the package system doesn't track the files of the packages")
+		}
+		if flagset.NArg() == 0 && !*flagUnowned {
+			return fmt.Errorf("-owns and -files require some arguments, got none")
 		}
+
+		printFiles := func(list FileList) error {
+			if *flagFormat == "json" {
+				return writeJSON(w, list)
+			}
+			for _, file := range list.Files {
+				switch {
+				case file.Missing:
+					fmt.Fprintf(w, "%10s %s\n", "missing", file.Path)
+				case file.Dir:
+					fmt.Fprintf(w, "%s %s/\n", formatSize(file.Size, *flagUnits), file.Path)
+				default:
+					fmt.Fprintf(w, "%s %s\n", formatSize(file.Size, *flagUnits), file.Path)
+				}
+			}
+			fmt.Fprintf(w, "%s total\n", formatSize(list.TotalSize, *flagUnits))
+			return nil
+		}
+
+		if *flagFiles {
+			list := FileList{Files: make([]FileEntry, 0, 256)}
+			for _, arg := range flagset.Args() {
+				id, exists := g.pkgids[arg]
+				if !exists {
+					return fmt.Errorf("package %s not installed", arg)
+				}
+				files, err := lister.Files(pkgs[id])
+				if err != nil {
+					return fmt.Errorf("list %s files: %v", arg, err)
+				}
+				for _, file := range files {
+					fi, err := fs.Stat(rootfs, file)
+					switch {
+					case err != nil:
+						list.Files = append(list.Files, FileEntry{Path: "/" + file, Missing: true})
+					case !fi.IsDir():
+						list.TotalSize += fi.Size()
+						list.Files = append(list.Files, FileEntry{Path: "/" + file, Size: fi.Size()})
+					}
+				}
+			}
+			return printFiles(list)
+		}
+
+		// Build the file ownership index.
+		// The paths are canonical because the packages might refer to the same file through different symlinked directories.
+		owners, resolved := make(map[string][]pkgid, 1e5), make(map[string]string, 1e3)
+		for i, pkg := range pkgs {
+			files, err := lister.Files(pkg)
+			if err != nil {
+				return fmt.Errorf("list %s files: %v", pkg.Name, err)
+			}
+			for _, file := range files {
+				file = canonicalPath(rootfs, resolved, file)
+				owners[file] = append(owners[file], pkgid(i))
+			}
+		}
+		// The packages listing a symlinked directory such as /lib own its target directory too.
+		for dir, target := range resolved {
+			if target != dir && len(owners[dir]) > 0 {
+				owners[target] = slices.Compact(slices.Sorted(slices.Values(append(owners[target], owners[dir]...))))
+			}
+		}
+
+		if *flagUnowned {
+			trees := []string{"/etc", "/opt", "/usr"}
+			if flagset.NArg() > 0 {
+				trees = flagset.Args()
+			}
+			var (
+				ignoreRE = makeRE(ignoredPaths...)
+				list     = FileList{Files: make([]FileEntry, 0, 256)}
+			)
+			for _, tree := range trees {
+				root := resolveDir(rootfs, resolved, filepath.Clean(abspath(tree)), 0)
+				err := fs.WalkDir(rootfs, root, func(file string, d fs.DirEntry, err error) error {
+					if errors.Is(err, fs.ErrNotExist) {
+						return nil
+					}
+					if err != nil {
+						return err
+					}
+					if file == root {
+						return nil
+					}
+					// Match the directories with a trailing slash too so that /usr/local/* ignores /usr/local itself.
+					ignored := ignoreRE.MatchString("/"+file) || d.IsDir() && ignoreRE.MatchString("/"+file+"/")
+					if ignored || len(owners[file]) > 0 {
+						if d.IsDir() && len(owners[file]) == 0 {
+							return fs.SkipDir
+						}
+						return nil
+					}
+					// Report the unowned directories as a whole.
+					if d.IsDir() {
+						size, err := dirsize(rootfs, file)
+						if err != nil {
+							return err
+						}
+						list.TotalSize += size
+						list.Files = append(list.Files, FileEntry{Path: "/" + file, Size: size, Dir: true})
+						return fs.SkipDir
+					}
+					fi, err := d.Info()
+					if err != nil {
+						return err
+					}
+					list.TotalSize += fi.Size()
+					list.Files = append(list.Files, FileEntry{Path: "/" + file, Size: fi.Size()})
+					return nil
+				})
+				if err != nil {
+					return fmt.Errorf("walk %s: %v", tree, err)
+				}
+			}
+			return printFiles(list)
+		}
+		report := make([]OwnsEntry, 0, flagset.NArg())
+		for _, arg := range flagset.Args() {
+			file := filepath.Clean(abspath(arg))
+			owner := owners[canonicalPath(rootfs, resolved, file)]
+			if len(owner) == 0 {
+				report = append(report, OwnsEntry{"/" + file, []string{}, []string{}, []string{}})
+				continue
+			}
+			// Walk the reverse dependencies until reaching the intentional or the unintentional top level packages.
+			var (
+				ownerpkgs    = make([]string, 0, 4)
+				keeperpkgs   = make([]string, 0, 16)
+				toplevelpkgs = make([]string, 0, 16)
+				seen         = make([]bool, g.n)
+				queue        = slices.Clone(owner)
+			)
+			for _, id := range queue {
+				ownerpkgs, seen[id] = append(ownerpkgs, pkgs[id].Name), true
+			}
+			for len(queue) > 0 {
+				u := queue[0]
+				queue = queue[1:]
+				if g.intentional[u] {
+					keeperpkgs = append(keeperpkgs, pkgs[u].Name)
+					continue
+				}
+				if g.toplevel(u) {
+					toplevelpkgs = append(toplevelpkgs, strings.Join(g.cycle(u), ","))
+				}
+				for _, r := range g.rdeps[u] {
+					if !seen[r] {
+						seen[r], queue = true, append(queue, r)
+					}
+				}
+			}
+			slices.Sort(keeperpkgs)
+			slices.Sort(toplevelpkgs)
+			report = append(report, OwnsEntry{"/" + file, ownerpkgs, keeperpkgs, toplevelpkgs})
+		}
+		if *flagFormat == "json" {
+			return writeJSON(w, report)
+		}
+		for _, entry := range report {
+			if len(entry.Owners) == 0 {
+				fmt.Fprintf(w, "%s is not owned by any package.\n\n", entry.Path)
+				continue
+			}
+			fmt.Fprintf(w, "%s is owned by %s\n\n", entry.Path, strings.Join(entry.Owners, " "))
+			if len(entry.Intentional) == 0 {
+				// Removing these would remove the file too.
+				fmt.Fprintf(w, "no intentional packages keep it installed, only unintentional top level packages: %s\n\n", strings.Join(entry.TopLevel, " "))
+				continue
+			}
+			fmt.Fprintf(w, "intentional packages keeping it installed: %s\n\n", strings.Join(entry.Intentional, " "))
+		}
+		return nil
 	}
 
 	// Handle -install.
 	if *flagInstall {
 		ignored := make([]string, 0, 64)
 		toinstall := make([]string, 0, 64)
+		unavailable := make([]string, 0, 64)
+		available := map[string][]string{} // the available packages for each entry, missing if unknown
+		if catalogue, ok := system.(Catalogue); ok {
+			available, err = catalogue.Available(slices.Sorted(maps.Keys(foundPackages)))
+			if err != nil {
+				return fmt.Errorf("load the available packages: %v", err)
+			}
+			for _, pkg := range slices.Sorted(maps.Keys(foundPackages)) {
+				// The installed packages are fine even if no repository provides them, e.g. the ones from the AUR.
+				if _, installed := g.pkgids[pkg]; installed {
+					continue
+				}
+				if matches, known := available[pkg]; known && len(matches) == 0 && strings.IndexByte(pkg, '*') == -1 {
+					unavailable = append(unavailable, pkg)
+				}
+			}
+		}
+		if len(unavailable) > 0 {
+			fmt.Fprintf(w, "Warning, no repository provides these, install them manually: %s.\n", strings.Join(unavailable, " "))
+		}
 		for _, pkg := range slices.Sorted(maps.Keys(foundPackages)) {
-			if _, exists := pkgids[pkg]; exists {
+			if strings.IndexByte(pkg, '*') != -1 {
+				// Expand the globs using the available packages.
+				matches, known := available[pkg]
+				switch {
+				case !known:
+					ignored = append(ignored, pkg)
+				case len(matches) == 0:
+					fmt.Fprintf(w, "Warning, %s matches no available package.\n", pkg)
+				default:
+					fmt.Fprintf(w, "Expanded %s to %s.\n", pkg, strings.Join(matches, " "))
+				}
+				for _, match := range matches {
+					if _, exists := g.pkgids[match]; !exists {
+						toinstall = append(toinstall, match)
+					}
+				}
 				continue
 			}
-			if strings.IndexByte(pkg, '*') == -1 {
-				toinstall = append(toinstall, pkg)
-			} else {
-				ignored = append(ignored, pkg)
+			if _, exists := g.pkgids[pkg]; exists || slices.Contains(unavailable, pkg) {
+				continue
 			}
+			toinstall = append(toinstall, pkg)
 		}
+		slices.Sort(toinstall)
+		toinstall = slices.Compact(toinstall)
 		if len(ignored) > 0 {
 			fmt.Fprintf(w, "Warning, ignoring globs: %s.\n", strings.Join(ignored, " "))
 		}
@@ -230,94 +751,147 @@ func Pkgtrim(w io.Writer, rootfs fs.FS, args []string) error {
 			fmt.Fprintln(w, "Nothing new to install.")
 			return nil
 		}
-		argv := system.Install(toinstall)
-		fmt.Fprintln(w, strings.Join(argv, " "))
-		if *flagDryrun {
-			return nil
-		}
-		cmd := exec.Command(argv[0], argv[1:]...)
-		cmd.Stdin = os.Stdin
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		if err := cmd.Run(); err != nil {
+		if err := run(w, system.Install(toinstall), *flagDryrun); err != nil {
 			return fmt.Errorf("install packages: %v", err)
 		}
 		return nil
 	}
 
-	// Runs a depth first search from a given node and builds toporder.
-	var traverse func(pkgid)
-	traverse = func(u pkgid) {
-		if visited[u] {
-			return
+	if *flagCycles {
+		cycles := make([]PackageSet, 0, 16)
+		for _, members := range slices.SortedFunc(slices.Values(g.sccs), func(a, b []pkgid) int { return cmp.Compare(a[0], b[0]) }) {
+			if len(members) == 1 {
+				continue
+			}
+			cycle := PackageSet{Packages: make([]string, 0, len(members))}
+			for _, i := range members {
+				cycle.Size += pkgs[i].Size
+				cycle.Packages = append(cycle.Packages, pkgs[i].Name)
+			}
+			cycles = append(cycles, cycle)
+		}
+		if *flagFormat == "json" {
+			return writeJSON(w, cycles)
 		}
-		visited[u] = true
-		for _, dep := range deps[u] {
-			traverse(dep)
+		for _, cycle := range cycles {
+			fmt.Fprintf(w, "%s %s\n", formatSize(cycle.Size, *flagUnits), strings.Join(cycle.Packages, " "))
 		}
-		toporder = append(toporder, u)
+		if len(cycles) == 0 {
+			fmt.Fprintln(w, "No dependency cycles found.")
+		}
+		return nil
 	}
 
-	// Computes the shared array and returns the unique size.
-	// Should be called after traverse().
-	computeUnique := func(seed ...pkgid) int64 {
-		// A package is not unique in the ith package if it has an rdep that is already shared or is outside the visited packages.
-		slices.Reverse(toporder)
-		var uniqueSize int64
-		for _, i := range toporder {
-			if slices.Contains(seed, i) {
-				uniqueSize += pkgs[i].Size
-				continue
+	if *flagDominators {
+		var tree func(pkgid) DominatorNode
+		tree = func(u pkgid) DominatorNode {
+			node := DominatorNode{pkgs[u].Name, g.domsize[u], make([]DominatorNode, 0, len(g.children[u]))}
+			for _, c := range g.children[u] {
+				node.Children = append(node.Children, tree(c))
 			}
-			for _, j := range rdeps[i] {
-				if shared[j] || !visited[j] || (!slices.Contains(seed, i) && intentional[i]) {
-					shared[i] = true
-					break
+			return node
+		}
+		trees := make([]DominatorNode, 0, 64)
+		if flagset.NArg() == 0 {
+			// The root's other children are the shared packages, no package owns them.
+			for _, u := range g.children[g.root] {
+				if g.intentional[u] || !g.hasRdeps(u) {
+					trees = append(trees, tree(u))
 				}
 			}
-			if !shared[i] {
-				uniqueSize += pkgs[i].Size
+		}
+		for _, pkg := range flagset.Args() {
+			id, exists := g.pkgids[pkg]
+			if !exists {
+				return fmt.Errorf("package %s not installed", pkg)
+			}
+			trees = append(trees, tree(id))
+		}
+		if *flagFormat == "json" {
+			return writeJSON(w, trees)
+		}
+		var printTree func(DominatorNode, int)
+		printTree = func(node DominatorNode, depth int) {
+			fmt.Fprintf(w, "%s %s%s\n", formatSize(node.Size, *flagUnits), strings.Repeat("  ", depth), node.Name)
+			for _, c := range node.Children {
+				printTree(c, depth+1)
 			}
 		}
-		return uniqueSize
+		for _, node := range trees {
+			printTree(node, 0)
+		}
+		return nil
+	}
+
+	if *flagWhatif != "" {
+		// The packages the intentional packages keep installed before and after the edits.
+		// The packages kept only before the edits become orphans, -remove would remove them.
+		keep := func(re *regexp.Regexp) []bool {
+			for i, pkg := range pkgs {
+				if re.MatchString(pkg.Name) {
+					g.traverse(g.deps, pkgid(i))
+				}
+			}
+			kept := slices.Clone(g.visited)
+			g.reset()
+			return kept
+		}
+		before, after := keep(intentionalRE), keep(whatifRE)
+		report := WhatifReport{
+			Unintentional: make([]string, 0, 16),
+			Intentional:   make([]string, 0, 16),
+			Orphans:       PackageSet{Packages: make([]string, 0, g.n)},
+			NewlyKept:     PackageSet{Packages: make([]string, 0, g.n)},
+		}
+		for i, pkg := range pkgs {
+			if g.intentional[i] && !whatifRE.MatchString(pkg.Name) {
+				report.Unintentional = append(report.Unintentional, pkg.Name)
+			} else if !g.intentional[i] && whatifRE.MatchString(pkg.Name) {
+				report.Intentional = append(report.Intentional, pkg.Name)
+			}
+			if before[i] && !after[i] {
+				report.Orphans.Size += pkg.Size
+				report.Orphans.Packages = append(report.Orphans.Packages, pkg.Name)
+			} else if !before[i] && after[i] {
+				report.NewlyKept.Size += pkg.Size
+				report.NewlyKept.Packages = append(report.NewlyKept.Packages, pkg.Name)
+			}
+		}
+		report.Reclaimed = report.Orphans.Size - report.NewlyKept.Size
+		if *flagFormat == "json" {
+			return writeJSON(w, report)
+		}
+		fmt.Fprintf(w, "newly unintentional packages: %s\n\n", strings.Join(report.Unintentional, " "))
+		fmt.Fprintf(w, "newly intentional packages: %s\n\n", strings.Join(report.Intentional, " "))
+		fmt.Fprintf(w, "orphaned packages (%s): %s\n\n", formatSize(report.Orphans.Size, *flagUnits), strings.Join(report.Orphans.Packages, " "))
+		fmt.Fprintf(w, "newly kept packages (%s): %s\n\n", formatSize(report.NewlyKept.Size, *flagUnits), strings.Join(report.NewlyKept.Packages, " "))
+		fmt.Fprintf(w, "reclaimed: %s\n", formatSize(report.Reclaimed, *flagUnits))
+		return nil
 	}
 
 	// Removes these packages but keeps the intentional ones.
 	remove := func(toremove []string) error {
-		toporder = toporder[:0]
-		for i := range n {
-			visited[i] = false
-		}
 		for _, pkg := range toremove {
-			if intentional[pkgids[pkg]] {
-				traverse(pkgids[pkg])
+			if g.intentional[g.pkgids[pkg]] {
+				g.traverse(g.deps, g.pkgids[pkg])
 			}
 		}
 		tokeep := make([]string, 0, 64)
 		toremove = slices.DeleteFunc(toremove, func(pkg string) bool {
-			if visited[pkgids[pkg]] {
+			if g.visited[g.pkgids[pkg]] {
 				tokeep = append(tokeep, pkg)
 				return true
 			}
 			return false
 		})
+		g.reset()
 		if len(tokeep) > 0 {
 			fmt.Fprintf(w, "Keeping packages intended directly or indirectly by %s: %s.\n\n", *flagTrimfile, strings.Join(tokeep, " "))
 		}
 		if len(toremove) == 0 {
 			return fmt.Errorf("nothing to remove")
 		}
-		argv := system.Remove(toremove)
-		fmt.Fprintln(w, strings.Join(argv, " "))
-		if *flagDryrun {
-			return nil
-		}
-		fmt.Fprintln(w)
-		cmd := exec.Command(argv[0], argv[1:]...)
-		cmd.Stdin = os.Stdin
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		if err := cmd.Run(); err != nil {
+		if err := run(w, system.Remove(toremove), *flagDryrun); err != nil {
 			return fmt.Errorf("remove selected packages: %v", err)
 		}
 		return nil
@@ -327,39 +901,93 @@ func Pkgtrim(w io.Writer, rootfs fs.FS, args []string) error {
 		if flagset.NArg() == 0 {
 			return fmt.Errorf("-graph requires some arguments, got none")
 		}
+		ids := make([]pkgid, 0, flagset.NArg())
 		for _, pkg := range flagset.Args() {
-			p, exists := pkgids[pkg]
+			id, exists := g.pkgids[pkg]
 			if !exists {
 				return fmt.Errorf("package %s not found", pkg)
 			}
-			traverse(p)
+			ids = append(ids, id)
 		}
-		fmt.Fprintln(w, "digraph {")
-		for _, arg := range flagset.Args() {
-			fmt.Fprintf(w, "  \"%s\" [style=filled fillcolor=lightgray]\n", arg)
+		return renderer.Graph(w, g.graph(ids))
+	}
+
+	if *flagWhy {
+		if flagset.NArg() != 1 {
+			return fmt.Errorf("-why requires exactly 1 argument, got %d", flagset.NArg())
+		}
+		id, exists := g.pkgids[flagset.Arg(0)]
+		if !exists {
+			return fmt.Errorf("package %s not found", flagset.Arg(0))
 		}
-		for i := range n {
-			if !visited[i] {
+
+		// Run a breadth first search on the reverse dependencies, stop at the intentional packages.
+		var (
+			visited      = make([]bool, g.n)
+			parent       = make([]pkgid, g.n) // the next package towards the argument on the shortest chain
+			queue        = []pkgid{id}
+			intentionals = make([]pkgid, 0, 16) // roots present in .pkgtrim
+			toplevels    = make([]pkgid, 0, 16) // unintentional top level roots
+		)
+		visited[id] = true
+		for len(queue) > 0 {
+			u := queue[0]
+			queue = queue[1:]
+			if g.intentional[u] {
+				intentionals = append(intentionals, u)
 				continue
 			}
-			visited[i] = false
-			for _, j := range deps[i] {
-				fmt.Fprintf(w, "  \"%s\" -> \"%s\"\n", pkgs[i].Name, pkgs[j].Name)
+			if g.toplevel(u) {
+				toplevels = append(toplevels, u)
+			}
+			for _, r := range g.rdeps[u] {
+				if !visited[r] {
+					visited[r], parent[r], queue = true, u, append(queue, r)
+				}
 			}
 		}
-		deps, rdeps, toporder = rdeps, deps, toporder[:0]
-		for _, pkg := range flagset.Args() {
-			traverse(pkgids[pkg])
+
+		// The comment of the .pkgtrim entry is either of the package or of the glob matching the package.
+		comment := func(pkg string) string {
+			if c, ok := foundPackages[pkg]; ok {
+				return c
+			}
+			for _, entry := range slices.Sorted(maps.Keys(foundPackages)) {
+				if foundPackages[entry] != "" && makeRE(entry).MatchString(pkg) {
+					return foundPackages[entry]
+				}
+			}
+			return ""
 		}
-		for i := range n {
-			if !visited[i] {
-				continue
+		chain := func(root pkgid) []string {
+			names := []string{pkgs[root].Name}
+			for u := root; u != id; u = parent[u] {
+				names = append(names, pkgs[parent[u]].Name)
 			}
-			for _, j := range deps[i] {
-				fmt.Fprintf(w, "  \"%s\" -> \"%s\"\n", pkgs[j].Name, pkgs[i].Name)
+			return names
+		}
+		report := WhyReport{pkgs[id].Name, make([]WhyChain, 0, len(intentionals)), make([]WhyChain, 0, len(toplevels))}
+		for _, root := range intentionals {
+			report.Intentional = append(report.Intentional, WhyChain{chain(root), comment(pkgs[root].Name)})
+		}
+		for _, root := range toplevels {
+			report.TopLevel = append(report.TopLevel, WhyChain{Packages: chain(root)})
+		}
+		if *flagFormat == "json" {
+			return writeJSON(w, report)
+		}
+		fmt.Fprintln(w, "kept by intentional packages:")
+		for _, c := range report.Intentional {
+			if c.Comment != "" {
+				fmt.Fprintf(w, "%s  # %s\n", strings.Join(c.Packages, " -> "), c.Comment)
+			} else {
+				fmt.Fprintln(w, strings.Join(c.Packages, " -> "))
 			}
 		}
-		fmt.Fprintln(w, "}")
+		fmt.Fprintln(w, "\nkept by unintentional top level packages:")
+		for _, c := range report.TopLevel {
+			fmt.Fprintln(w, strings.Join(c.Packages, " -> "))
+		}
 		return nil
 	}
 
@@ -367,153 +995,153 @@ func Pkgtrim(w io.Writer, rootfs fs.FS, args []string) error {
 		if flagset.NArg() != 2 {
 			return fmt.Errorf("-trace requires exactly 2 arguments, got %d", flagset.NArg())
 		}
-		src, srcExists := pkgids[flagset.Arg(0)]
-		dst, dstExists := pkgids[flagset.Arg(1)]
+		src, srcExists := g.pkgids[flagset.Arg(0)]
+		dst, dstExists := g.pkgids[flagset.Arg(1)]
 		if !srcExists {
 			return fmt.Errorf("package %s not found", flagset.Arg(0))
 		}
 		if !dstExists {
 			return fmt.Errorf("package %s not found", flagset.Arg(1))
 		}
-		traverse(src)
-		if !visited[dst] {
-			return fmt.Errorf("package %s is not a dependency of %s", flagset.Arg(1), flagset.Arg(0))
-		}
-		fmt.Fprintf(w, "strict digraph {\n  \"%s\" [style=filled fillcolor=lightgray]\n  \"%s\" [style=filled fillcolor=lightgray]\n", flagset.Arg(0), flagset.Arg(1))
-		path := make([]string, 0, 64)
-		var findpaths func(pkgid)
-		findpaths = func(pkg pkgid) {
-			if pkg == src {
-				slices.Reverse(path)
-				fmt.Fprintf(w, "  \"%s\"\n", strings.Join(path, "\" -> \""))
-				slices.Reverse(path)
-				return
-			}
-			for _, rdep := range rdeps[pkg] {
-				if visited[rdep] {
-					path = append(path, pkgs[rdep].Name)
-					findpaths(rdep)
-					path = path[:len(path)-1]
-				}
-			}
+		trace, err := g.trace(src, dst)
+		if err != nil {
+			return err
 		}
-		path = append(path, flagset.Arg(1))
-		findpaths(dst)
-		fmt.Fprintln(w, "}")
-		return nil
+		return renderer.Trace(w, trace)
 	}
 
 	if flagset.NArg() > 0 {
 		seed := make([]pkgid, flagset.NArg())
 		for i, pkg := range flagset.Args() {
-			id, exists := pkgids[pkg]
+			id, exists := g.pkgids[pkg]
 			if !exists {
 				return fmt.Errorf("package %s not installed", pkg)
 			}
-			traverse(id)
 			seed[i] = id
 		}
-		computeUnique(seed...)
-		var (
-			sharedsize        int64
-			uniquesize        int64
-			sharedpkgs        = make([]string, 0, n) // dependencies that other packages also have
-			uniquepkgs        = make([]string, 0, n) // dependencies unique to the arguments
-			intentionalpkgs   = make([]string, 0, n) // top level rdeps that are present in .pkgtrim
-			unintentionalpkgs = make([]string, 0, n) // top level rdeps that are not present in .pkgtrim
-		)
-		for i, pkg := range pkgs {
-			if shared[i] {
-				sharedsize += pkg.Size
-				sharedpkgs = append(sharedpkgs, pkg.Name)
-			} else if visited[i] {
-				uniquesize += pkg.Size
-				uniquepkgs = append(uniquepkgs, pkg.Name)
-			}
-			shared[i], visited[i] = false, false
+		report := g.dependencies(seed)
+		if err := renderer.Dependencies(w, report); err != nil {
+			return err
 		}
-
-		// Compute top level rdeps by running bfs in reverse.
-		deps, rdeps, toporder = rdeps, deps, toporder[:0]
-		for _, i := range seed {
-			traverse(i)
+		if *flagRemove {
+			return remove(report.Unique.Packages)
 		}
-		deps, rdeps, toporder = rdeps, deps, toporder[:0]
-		for i, pkg := range pkgs {
-			if !visited[i] || len(rdeps[i]) > 0 {
-				continue
+		return nil
+	}
+
+	// Runs the interactive mode over the listing's entries and then executes the confirmed changes.
+	tui := func(entries []TopLevelEntry) error {
+		m := &tuiModel{trimfile: *flagTrimfile, units: *flagUnits}
+		for _, e := range entries {
+			// The unique dependencies are the dominator subtree of the package without its own cycle.
+			uniqueDeps := make([]string, 0, 16)
+			for _, u := range g.dominated(g.pkgids[e.Name]) {
+				if !slices.Contains(e.Packages, pkgs[u].Name) {
+					uniqueDeps = append(uniqueDeps, pkgs[u].Name)
+				}
 			}
-			if intentional[i] {
-				intentionalpkgs = append(intentionalpkgs, pkg.Name)
-			} else {
-				unintentionalpkgs = append(unintentionalpkgs, pkg.Name)
+			slices.Sort(uniqueDeps)
+			m.entries = append(m.entries, tuiEntry{TopLevelEntry: e, uniqueDeps: uniqueDeps})
+		}
+		m.plan = func(remove []string) [][]string {
+			seed := make([]pkgid, 0, len(remove))
+			for _, pkg := range remove {
+				seed = append(seed, g.pkgids[pkg])
 			}
+			return system.Remove(g.unique(seed))
+		}
+		if err := runTUI(os.Stdin, w, m); err != nil {
+			return err
+		}
+		if !m.confirmed {
+			fmt.Fprintln(w, "No changes made.")
+			return nil
 		}
 
-		fmt.Fprintf(w, "shared dependencies (%s): %s\n\n", humanize(sharedsize), strings.Join(sharedpkgs, " "))
-		fmt.Fprintf(w, "unique dependencies (%s): %s\n\n", humanize(uniquesize), strings.Join(uniquepkgs, " "))
-		fmt.Fprintf(w, "intentional top level rdeps: %s\n\n", strings.Join(intentionalpkgs, " "))
-		fmt.Fprintf(w, "unintentional top level rdeps: %s\n\n", strings.Join(unintentionalpkgs, " "))
-
-		if *flagRemove {
-			return remove(uniquepkgs)
+		remove, keep := m.marked()
+		if len(keep) > 0 {
+			fmt.Fprintf(w, "Appending to %s:\n%s\n", *flagTrimfile, strings.Join(keep, "\n"))
+			if !*flagDryrun {
+				f, err := os.OpenFile(*flagTrimfile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+				if err != nil {
+					return fmt.Errorf("open trimfile: %v", err)
+				}
+				// Start on a new line if the last line of the file is unterminated.
+				prefix := ""
+				if len(trimfileBytes) > 0 && trimfileBytes[len(trimfileBytes)-1] != '\n' {
+					prefix = "\n"
+				}
+				_, err = fmt.Fprintf(f, "%s%s\n", prefix, strings.Join(keep, "\n"))
+				if err := errors.Join(err, f.Close()); err != nil {
+					return fmt.Errorf("append to trimfile: %v", err)
+				}
+			}
+			fmt.Fprintln(w)
+		}
+		if len(remove) > 0 {
+			if err := run(w, m.plan(remove), *flagDryrun); err != nil {
+				return fmt.Errorf("remove selected packages: %v", err)
+			}
 		}
 		return nil
 	}
 
 	// No args mode.
-	// For each top level undocumented package compute the total and unique usage via a breadth first search.
-	cnt := 0
-	for i := range n {
-		if len(rdeps[i]) > 0 || intentional[i] {
-			continue
-		}
-		cnt++
-		traverse(pkgid(i))
-		unique[i] = computeUnique(pkgid(i))
+	// List the top level undocumented packages.
 
-		// Reset the arrays for the next iteration.
-		for _, j := range toporder {
-			visited[j], shared[j] = false, false
+	// -stale lists only the packages installed and last used before the cutoff.
+	// The last use is the last access time of the files of the package and its unique dependencies.
+	// The unique dependencies count because e.g. a plugin might be in use even if the package's own files are not.
+	// The directories are skipped because they are accessed by all the packages.
+	var stale func(pkgid) (time.Time, bool, error)
+	if *flagStale != "" {
+		lister, ok := system.(FileLister)
+		if !ok {
+			return fmt.Errorf("the package system doesn't track the files of the packages")
+		}
+		cutoff := now().AddDate(0, 0, -staleDays)
+		stale = func(id pkgid) (time.Time, bool, error) {
+			if pkgs[id].InstallDate.IsZero() || pkgs[id].InstallDate.After(cutoff) {
+				return time.Time{}, false, nil
+			}
+			var last time.Time
+			for _, u := range g.dominated(id) {
+				files, err := lister.Files(pkgs[u])
+				if err != nil {
+					return time.Time{}, false, fmt.Errorf("list %s files: %v", pkgs[u].Name, err)
+				}
+				for _, file := range files {
+					if fi, err := fs.Stat(rootfs, file); err == nil && !fi.IsDir() && atime(fi).After(last) {
+						last = atime(fi)
+					}
+				}
+			}
+			return last, !last.After(cutoff), nil
 		}
-		toporder = toporder[:0]
 	}
-	if cnt == 0 && !*flagRemove {
-		fmt.Fprintln(w, "No unintenional packages found. Use `-f /dev/null` to print all.")
-		return nil
+	entries, err := g.topLevel(*flagSort == "age", stale)
+	if err != nil {
+		return err
 	}
-
-	sizeorder := make([]pkgid, n)
-	for i := range n {
-		sizeorder[i] = pkgid(i)
+	if *flagTui {
+		return tui(entries)
 	}
-	slices.SortFunc(sizeorder, func(a, b pkgid) int {
-		return cmp.Compare(unique[a], unique[b])
-	})
 
-	for _, id := range sizeorder {
-		pkg := pkgs[id]
-		if len(rdeps[id]) > 0 || intentional[id] {
-			continue
+	// -remove prints only the commands if there's nothing to list.
+	if len(entries) > 0 || !*flagRemove {
+		if err := renderer.TopLevel(w, entries); err != nil {
+			return err
 		}
-		fmt.Fprintf(w, "%s %-24s %s\n", humanize(unique[id]), pkg.Name, pkg.Desc)
 	}
 
 	if *flagRemove {
+		seed := make([]pkgid, 0, 64)
 		for i := range pkgs {
-			if len(rdeps[i]) == 0 && !intentional[i] {
-				traverse(pkgid(i))
-			}
-		}
-		computeUnique()
-		toremove := make([]string, 0, 64)
-		for _, i := range toporder {
-			if !shared[i] {
-				toremove = append(toremove, pkgs[i].Name)
+			if g.toplevel(pkgid(i)) {
+				seed = append(seed, pkgid(i))
 			}
 		}
-		slices.Sort(toremove)
-		return remove(toremove)
+		return remove(g.unique(seed))
 	}
 	return nil
 }
@@ -4,8 +4,15 @@
 package main
 
 import (
+	"fmt"
+	"io"
+	"maps"
 	"os"
+	"slices"
+	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
 
 	"github.com/ypsu/efftesting"
 )
@@ -21,25 +28,34 @@ func TestAbspath(t *testing.T) {
 	et.Expect("relative not under wd", abspath("../../var/lib/package"), "var/lib/package")
 }
 
-func TestHumanize(t *testing.T) {
+func TestFormatSize(t *testing.T) {
 	et := efftesting.New(t)
-	et.Expect("", humanize(0), "    0.0 MB")
-	et.Expect("", humanize(-1), "   -0.0 MB")
-	et.Expect("", humanize(-123456), "   -0.1 MB")
-	et.Expect("", humanize(1), "    0.0 MB")
-	et.Expect("", humanize(12), "    0.0 MB")
-	et.Expect("", humanize(123), "    0.0 MB")
-	et.Expect("", humanize(1234), "    0.0 MB")
-	et.Expect("", humanize(12345), "    0.0 MB")
-	et.Expect("", humanize(123456), "    0.1 MB")
-	et.Expect("", humanize(1234567), "    1.2 MB")
-	et.Expect("", humanize(12345678), "   12.3 MB")
-	et.Expect("", humanize(123456789), "  123.5 MB")
-	et.Expect("", humanize(1234567890), " 1234.6 MB")
-	et.Expect("", humanize(12345678901), "12345.7 MB")
-	et.Expect("", humanize(123456789012), "123456.8 MB")
-	et.Expect("", humanize(1234567890123), "1234567.9 MB")
-	et.Expect("", humanize(12345678901234), "12345678.9 MB")
+	et.Expect("", formatSize(0, "MB"), "    0.0 MB")
+	et.Expect("", formatSize(-1, "MB"), "   -0.0 MB")
+	et.Expect("", formatSize(-123456, "MB"), "   -0.1 MB")
+	et.Expect("", formatSize(1, "MB"), "    0.0 MB")
+	et.Expect("", formatSize(12, "MB"), "    0.0 MB")
+	et.Expect("", formatSize(123, "MB"), "    0.0 MB")
+	et.Expect("", formatSize(1234, "MB"), "    0.0 MB")
+	et.Expect("", formatSize(12345, "MB"), "    0.0 MB")
+	et.Expect("", formatSize(123456, "MB"), "    0.1 MB")
+	et.Expect("", formatSize(1234567, "MB"), "    1.2 MB")
+	et.Expect("", formatSize(12345678, "MB"), "   12.3 MB")
+	et.Expect("", formatSize(123456789, "MB"), "  123.5 MB")
+	et.Expect("", formatSize(1234567890, "MB"), " 1234.6 MB")
+	et.Expect("", formatSize(12345678901, "MB"), "12345.7 MB")
+	et.Expect("", formatSize(123456789012, "MB"), "123456.8 MB")
+	et.Expect("", formatSize(1234567890123, "MB"), "1234567.9 MB")
+	et.Expect("", formatSize(12345678901234, "MB"), "12345678.9 MB")
+	et.Expect("", formatSize(1234567890, "GB"), "    1.2 GB")
+	et.Expect("", formatSize(1234567890, "GiB"), "    1.1 GiB")
+	et.Expect("", formatSize(1234567, "MiB"), "    1.2 MiB")
+	et.Expect("", formatSize(1234567, "KiB"), " 1205.6 KiB")
+	et.Expect("", formatSize(1234567, "B"), "   1234567 B")
+	et.Expect("", formatSize(123, "auto"), "    123 B  ")
+	et.Expect("", formatSize(1234, "auto"), "    1.2 KiB")
+	et.Expect("", formatSize(1234567, "auto"), "    1.2 MiB")
+	et.Expect("", formatSize(-1234567890, "auto"), "   -1.1 GiB")
 }
 
 func TestGlobs(t *testing.T) {
@@ -51,6 +67,315 @@ func TestGlobs(t *testing.T) {
 	et.Expect("", makeRE("a", "b*", "c"), "^(a|b.*|c)$")
 }
 
+func TestParseconfigComments(t *testing.T) {
+	et := efftesting.New(t)
+	found := map[string]string{}
+	cfg := "# base packages\nbase sudo\npolkit  # allow administration\n\ntmux\n# dev tools\ngo  # the compiler\ngit\n"
+	if err := parseconfig(found, 0, []byte(cfg)); err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for _, pkg := range slices.Sorted(maps.Keys(found)) {
+		lines = append(lines, fmt.Sprintf("%s: %q", pkg, found[pkg]))
+	}
+	et.Expect("", strings.Join(lines, ", "), `base: "base packages", git: "dev tools", go: "the compiler", polkit: "allow administration", sudo: "base packages", tmux: ""`)
+}
+
+func TestRenderers(t *testing.T) {
+	et := efftesting.New(t)
+	render := func(format string, f func(Renderer, io.Writer) error) string {
+		r, err := NewRenderer(format, textRenderer{"MB", []string{"unique", "foreign"}, false})
+		if err != nil {
+			return "error: " + err.Error()
+		}
+		w := &strings.Builder{}
+		if err := f(r, w); err != nil {
+			return "error: " + err.Error()
+		}
+		return w.String()
+	}
+	entries := []TopLevelEntry{
+		{Name: "a", Packages: []string{"a"}, Desc: "first, \"quoted\"", UniqueSize: 1234567, Foreign: true, TotalSize: 2345678, Deps: 3, SharedWith: 2},
+		{Name: "b", Packages: []string{"b", "c"}, UniqueSize: 42, InstallDate: time.Date(2024, 5, 6, 9, 8, 9, 0, time.FixedZone("CEST", 2*60*60))},
+	}
+	toplevel := func(r Renderer, w io.Writer) error { return r.TopLevel(w, entries) }
+	et.Expect("", render("text", toplevel), "    1.2 MB foreign a                        first, \"quoted\"\n    0.0 MB         b,c                      \n")
+	et.Expect("", render("csv", toplevel), "name,packages,desc,unique_size,install_date,last_used,foreign,total_size,deps,version,reason,shared_with\na,a,\"first, \"\"quoted\"\"\",1234567,,,true,2345678,3,,unknown,2\nb,b c,,42,2024-05-06T07:08:09Z,,false,0,0,,unknown,0\n")
+	et.Expect("", render("json", toplevel), `
+		[
+		  {
+		    "name": "a",
+		    "packages": [
+		      "a"
+		    ],
+		    "desc": "first, \"quoted\"",
+		    "unique_size": 1234567,
+		    "foreign": true,
+		    "total_size": 2345678,
+		    "deps": 3,
+		    "reason": "unknown",
+		    "shared_with": 2
+		  },
+		  {
+		    "name": "b",
+		    "packages": [
+		      "b",
+		      "c"
+		    ],
+		    "desc": "",
+		    "unique_size": 42,
+		    "install_date": "2024-05-06T07:08:09Z",
+		    "total_size": 0,
+		    "deps": 0,
+		    "reason": "unknown",
+		    "shared_with": 0
+		  }
+		]
+	`)
+	et.Expect("", render("dot", toplevel), "error: -format=dot supports only -trace and -graph")
+	et.Expect("", render("yaml", toplevel), "error: invalid -format=yaml, want text, json, csv, or dot")
+
+	trace := TraceResult{Src: "a", Dst: "d", Paths: [][]string{{"a", "b", "c", "d"}, {"a", "d"}}, OptionalEdges: [][2]string{{"b", "c"}}}
+	tracer := func(r Renderer, w io.Writer) error { return r.Trace(w, trace) }
+	et.Expect("", render("dot", tracer), "strict digraph {\n  \"a\" [style=filled fillcolor=lightgray]\n  \"d\" [style=filled fillcolor=lightgray]\n  \"a\" -> \"b\"\n  \"b\" -> \"c\" [style=dashed]\n  \"c\" -> \"d\"\n  \"a\" -> \"d\"\n}\n")
+	et.Expect("", render("csv", tracer), "from,to,optional\na,b,false\nb,c,true\nc,d,false\na,d,false\n")
+
+	graph := DependencyGraph{Packages: []string{"b"}, Edges: [][2]string{{"b", "c"}, {"a", "b"}}, OptionalEdges: [][2]string{{"b", "c"}}}
+	grapher := func(r Renderer, w io.Writer) error { return r.Graph(w, graph) }
+	et.Expect("", render("text", grapher), `
+		digraph {
+		  "b" [style=filled fillcolor=lightgray]
+		  "b" -> "c" [style=dashed]
+		  "a" -> "b"
+		}
+	`)
+	et.Expect("", render("csv", grapher), `
+		from,to,optional
+		b,c,true
+		a,b,false
+	`)
+}
+
+func TestDepgraph(t *testing.T) {
+	et := efftesting.New(t)
+	pkgs := []Package{
+		{Name: "app", Size: 100, Deps: []string{"lib"}, OptDeps: []string{"plugin"}, InstallDate: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{Name: "editor", Size: 10, Deps: []string{"lib"}},
+		{Name: "lib", Size: 20, Deps: []string{"libc"}},
+		{Name: "libc", Size: 5},
+		{Name: "plugin", Size: 7, Deps: []string{"lib"}},
+		{Name: "x", Size: 1, Deps: []string{"y"}, InstallDate: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{Name: "y", Size: 2, Deps: []string{"x", "libc"}},
+	}
+	g := newDepgraph(pkgs, makeRE("editor"), false)
+	id := func(name string) pkgid { return g.pkgids[name] }
+	toplevel := func(byAge bool, stale func(pkgid) (time.Time, bool, error)) string {
+		entries, err := g.topLevel(byAge, stale)
+		if err != nil {
+			return "error: " + err.Error()
+		}
+		lines := make([]string, 0, len(entries))
+		for _, e := range entries {
+			lines = append(lines, fmt.Sprintf("%s %v unique=%d total=%d deps=%d sharedwith=%d lastused=%s", e.Name, e.Packages, e.UniqueSize, e.TotalSize, e.Deps, e.SharedWith, formatDate(e.LastUsed)))
+		}
+		return strings.Join(lines, "\n")
+	}
+	et.Expect("", toplevel(false, nil), `
+		x [x y] unique=3 total=8 deps=1 sharedwith=3 lastused=-
+		plugin [plugin] unique=7 total=32 deps=2 sharedwith=3 lastused=-
+		app [app] unique=100 total=125 deps=2 sharedwith=3 lastused=-`)
+	et.Expect("", toplevel(true, nil), `
+		plugin [plugin] unique=7 total=32 deps=2 sharedwith=3 lastused=-
+		x [x y] unique=3 total=8 deps=1 sharedwith=3 lastused=-
+		app [app] unique=100 total=125 deps=2 sharedwith=3 lastused=-`)
+	stale := func(u pkgid) (time.Time, bool, error) { return pkgs[u].InstallDate, u == id("x"), nil }
+	et.Expect("", toplevel(false, stale), "x [x y] unique=3 total=8 deps=1 sharedwith=3 lastused=2024-02-01")
+	broken := func(u pkgid) (time.Time, bool, error) { return time.Time{}, false, fmt.Errorf("no files") }
+	et.Expect("", toplevel(false, broken), "error: no files")
+
+	et.Expect("", fmt.Sprintf("%+v", g.dependencies([]pkgid{id("app")})), "{Shared:{Size:25 Packages:[lib libc]} Unique:{Size:100 Packages:[app]} IntentionalRdeps:[] UnintentionalRdeps:[app] OptionallyUsedBy:[] SharedWith:3}")
+	et.Expect("", fmt.Sprintf("%+v", g.dependencies([]pkgid{id("lib")})), "{Shared:{Size:5 Packages:[libc]} Unique:{Size:20 Packages:[lib]} IntentionalRdeps:[editor] UnintentionalRdeps:[app plugin] OptionallyUsedBy:[] SharedWith:4}")
+	et.Expect("", fmt.Sprintf("%+v", g.dependencies([]pkgid{id("y")})), "{Shared:{Size:5 Packages:[libc]} Unique:{Size:3 Packages:[x y]} IntentionalRdeps:[] UnintentionalRdeps:[x,y] OptionallyUsedBy:[] SharedWith:3}")
+
+	trace := func(src, dst string) string {
+		tr, err := g.trace(id(src), id(dst))
+		if err != nil {
+			return "error: " + err.Error()
+		}
+		return fmt.Sprintf("%+v", tr)
+	}
+	et.Expect("", trace("app", "libc"), "{Src:app Dst:libc Paths:[[app lib libc]] OptionalEdges:[]}")
+	et.Expect("", trace("libc", "app"), "error: package app is not a dependency of libc")
+
+	et.Expect("", fmt.Sprintf("%+v", g.graph([]pkgid{id("lib")})), "{Packages:[lib] Edges:[[lib libc] [app lib] [editor lib] [plugin lib] [app plugin]] OptionalEdges:[[app plugin]]}")
+	et.Expect("", fmt.Sprintf("%+v", g.graph([]pkgid{id("x"), id("y")})), "{Packages:[x y] Edges:[[x y] [y x] [y libc]] OptionalEdges:[]}")
+	et.Expect("", fmt.Sprint(g.unique([]pkgid{id("app"), id("x")})), "[app x y]")
+
+	// The builders reset the markers so they can be called repeatedly.
+	et.Expect("", slices.Contains(g.visited, true) || slices.Contains(g.shared, true) || len(g.toporder) > 0, "false")
+}
+
+func TestParseKeys(t *testing.T) {
+	et := efftesting.New(t)
+	parse := func(s string) string { return strings.Join(parseKeys([]byte(s)), " ") }
+	et.Expect("", parse("jk\r"), "j k enter")
+	et.Expect("", parse("\x1b[A\x1b[B\x1bOC\x1b[D"), "up down right left")
+	et.Expect("", parse("\x1b\x1b[5~x"), "esc esc x")
+	et.Expect("", parse("é\x7f\x03"), "é backspace ctrl-c")
+}
+
+func TestTUI(t *testing.T) {
+	et := efftesting.New(t)
+	m := &tuiModel{
+		entries: []tuiEntry{
+			{TopLevelEntry: TopLevelEntry{Name: "a", Packages: []string{"a"}, Desc: "first", UniqueSize: 1e6}, uniqueDeps: []string{"liba"}},
+			{TopLevelEntry: TopLevelEntry{Name: "b", Packages: []string{"b", "c"}, Desc: "second", UniqueSize: 2e6}},
+			{TopLevelEntry: TopLevelEntry{Name: "d", Packages: []string{"d"}, Desc: "third", UniqueSize: 3e6}},
+		},
+		trimfile: ".pkgtrim",
+		units:    "MB",
+		plan:     func(remove []string) [][]string { return [][]string{append([]string{"rm"}, remove...)} },
+	}
+	keys := func(keys ...string) string {
+		for _, key := range keys {
+			m.update(key)
+		}
+		return strings.Join(m.view(4, 40), "|")
+	}
+	et.Expect("initial", keys(), "j/k: move, enter: expand, r: remove, i: |>        1.0 MB a                       |         2.0 MB b,c                     ")
+	et.Expect("expand", keys("enter"), "j/k: move, enter: expand, r: remove, i: |>        1.0 MB a                       |        liba")
+	et.Expect("scroll", keys("down", "r", "j"), "j/k: move, enter: expand, r: remove, i: | [R]     2.0 MB b,c                     |>        3.0 MB d                       ")
+	et.Expect("comment", keys("i", "k", "e", "e", "p", "backspace", "backspace"), "j/k: move, enter: expand, r: remove, i: | [R]     2.0 MB b,c                     |>        3.0 MB d                       |Comment for d (enter to save, esc to can")
+	et.Expect("keep", keys("enter"), "j/k: move, enter: expand, r: remove, i: | [R]     2.0 MB b,c                     |>[K]     3.0 MB d                       ")
+	et.Expect("confirm", keys("q"), "Commands to run:|  rm b c|Lines to append to .pkgtrim:|  d  # ke||Press y to confirm, n to go back.")
+	et.Expect("unmark", keys("n", "up", "r", "q"), "Lines to append to .pkgtrim:|  d  # ke||Press y to confirm, n to go back.")
+	et.Expect("unconfirmed", m.confirmed, "false")
+	keys("y")
+	et.Expect("confirmed", m.confirmed, "true")
+}
+
+func TestGentooDepend(t *testing.T) {
+	et := efftesting.New(t)
+	parse := func(spec string) string {
+		dep, err := parseGentooDepend(spec)
+		if err != nil {
+			return "error: " + err.Error()
+		}
+		return dep.String()
+	}
+	et.Expect("", parse(""), "( )")
+	et.Expect("", parse("sys-libs/zlib"), "( sys-libs/zlib )")
+	et.Expect("", parse(">=dev-libs/openssl-3.0.1-r2:0/3=[abi_x86_64(-)]"), "( dev-libs/openssl:0 )")
+	et.Expect("", parse("=dev-lang/python-3.12*:3.12 ~app-editors/vim-core-9.1.0395"), "( dev-lang/python:3.12 app-editors/vim-core )")
+	et.Expect("", parse("!<net-misc/curl-7.0 !!app-editors/vim-tiny"), "( !net-misc/curl !app-editors/vim-tiny )")
+	et.Expect("", parse("dev-libs/expat:= sys-libs/ncurses:* app-misc/foo::gentoo"), "( dev-libs/expat sys-libs/ncurses app-misc/foo )")
+	et.Expect("", parse("|| ( dev-lang/python:3.13 dev-lang/python:3.12 ) a/b"), "( || ( dev-lang/python:3.13 dev-lang/python:3.12 ) a/b )")
+	et.Expect("", parse("ssl? ( || ( a/b ( c/d e/f ) ) ) !test? ( g/h )"), "( ( || ( a/b ( c/d e/f ) ) ) ( g/h ) )")
+	et.Expect("", parse("|| a/b"), `error: parse "|| a/b": missing ( after ||`)
+	et.Expect("", parse("a/b )"), `error: parse "a/b )": unbalanced )`)
+	et.Expect("", parse("|| ( a/b"), `error: parse "|| ( a/b": missing )`)
+	et.Expect("", parse("zlib"), `error: parse "zlib": parse atom "zlib": want category/package`)
+	et.Expect("", parse(">=sys-libs/zlib"), `error: parse ">=sys-libs/zlib": parse atom ">=sys-libs/zlib": no version found`)
+}
+
+func TestPlist(t *testing.T) {
+	et := efftesting.New(t)
+	decode := func(plist string) string {
+		v, err := decodePlist(strings.NewReader(plist))
+		if err != nil {
+			return "error: " + err.Error()
+		}
+		return fmt.Sprintf("%v", v)
+	}
+	et.Expect("", decode(`<?xml version="1.0"?><plist version="1.0"><string>hello</string></plist>`), "hello")
+	et.Expect("", decode(`<plist><dict>
+		<key>s</key> <string> a &lt; b </string>
+		<key>i</key> <integer>-42</integer>
+		<key>r</key> <real>1.5</real>
+		<key>t</key> <true/>
+		<key>f</key> <false/>
+		<key>d</key> <data>aGVs
+			bG8=</data>
+		<key>a</key> <array><string>x</string><dict/><array/></array>
+	</dict></plist>`), "map[a:[x map[] []] d:[104 101 108 108 111] f:false i:-42 r:1.5 s:a < b t:true]")
+	et.Expect("", decode(``), "error: EOF")
+	et.Expect("", decode(`<dict/>`), "error: missing <plist> root element")
+	et.Expect("", decode(`<plist></plist>`), "error: empty <plist>")
+	et.Expect("", decode(`<plist><dict><string>a</string></dict></plist>`), "error: got <string> in dict, want <key>")
+	et.Expect("", decode(`<plist><dict><key>a</key></dict></plist>`), `error: missing value for key "a"`)
+	et.Expect("", decode(`<plist><dict><key>a</key><integer>x</integer></dict></plist>`), `error: decode "a": strconv.ParseInt: parsing "x": invalid syntax`)
+	et.Expect("", decode(`<plist><array>hello</array></plist>`), `error: unexpected text "hello"`)
+	et.Expect("", decode(`<plist><blob/></plist>`), "error: unknown element <blob>")
+}
+
+func TestVoidPkgname(t *testing.T) {
+	et := efftesting.New(t)
+	et.Expect("", voidPkgname("bash"), "bash")
+	et.Expect("", voidPkgname("xbps-triggers"), "xbps-triggers")
+	et.Expect("", voidPkgname("xbps-triggers-0.128_1"), "xbps-triggers")
+	et.Expect("", voidPkgname("glibc>=2.38_1"), "glibc")
+	et.Expect("", voidPkgname("foo<2.0_1"), "foo")
+	et.Expect("", voidPkgname("linux6.6-6.6.*"), "linux6.6")
+	et.Expect("", voidPkgname("ca-certificates-20240203+3.98_1"), "ca-certificates")
+}
+
+func TestRPMWithoutManifest(t *testing.T) {
+	et := efftesting.New(t)
+	rootfs := fstest.MapFS{"var/lib/rpm/rpmdb.sqlite": &fstest.MapFile{}}
+	_, err := rpm{rootfs, "dnf"}.Packages()
+	et.Expect("", err, "read /var/lib/pkgtrim/rpm.manifest: open var/lib/pkgtrim/rpm.manifest: file does not exist")
+}
+
+func TestArchZstdSyncDB(t *testing.T) {
+	et := efftesting.New(t)
+	rootfs := fstest.MapFS{
+		"var/lib/pacman/local/vim-9.1-1/desc": {Data: []byte("%NAME%\nvim\n\n%VERSION%\n9.1-1\n")},
+		"var/lib/pacman/sync/core.db":         {Data: []byte("\x28\xb5\x2f\xfd\x00\x00\x00\x00\x00\x00")}, // starts with the zstd magic
+	}
+	system, err := NewPackageSystem(rootfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkgs, err := system.Packages()
+	et.Expect("packages", err, "null")
+	et.Expect("foreign", pkgs[0].Foreign, "false")
+	available, err := system.(Catalogue).Available([]string{"vim"})
+	et.Expect("available", fmt.Sprint(available, err), "map[] <nil>")
+}
+
+func TestCompositeWithoutDistro(t *testing.T) {
+	et := efftesting.New(t)
+	c := composite{[]PackageSystem{flatpak{}, snap{}}, []string{flatpakPrefix, snapPrefix}, []string{"flatpak", "snapd"}}
+	_, err := c.Available([]string{"flatpak:org.gimp.GIMP", "vim"})
+	et.Expect("", err, "vim has no flatpak: or snap: prefix and no distribution package system found")
+	et.Expect("", fmt.Sprint(c.Install([]string{"flatpak:org.gimp.GIMP", "snap:firefox"})), "[[flatpak install org.gimp.GIMP] [sudo snap install firefox]]")
+}
+
+func TestStaleUniqueDeps(t *testing.T) {
+	et := efftesting.New(t)
+	oldwd, oldnow := wd, now
+	t.Cleanup(func() { wd, now = oldwd, oldnow })
+	wd, now = "/home/user", func() time.Time { return time.Date(2024, 9, 1, 0, 0, 0, 0, time.UTC) }
+	rootfs := fstest.MapFS{
+		"var/lib/pacman/local/app-1-1/desc":     {Data: []byte("%NAME%\napp\n\n%VERSION%\n1-1\n\n%INSTALLDATE%\n1704067200\n\n%DEPENDS%\nplugin\n")},
+		"var/lib/pacman/local/app-1-1/files":    {Data: []byte("%FILES%\nusr/\nusr/bin/\nusr/bin/app\n")},
+		"var/lib/pacman/local/plugin-1-1/desc":  {Data: []byte("%NAME%\nplugin\n\n%VERSION%\n1-1\n\n%REASON%\n1\n")},
+		"var/lib/pacman/local/plugin-1-1/files": {Data: []byte("%FILES%\nusr/\nusr/lib/\nusr/lib/plugin.so\n")},
+		"usr/bin/app":                           {ModTime: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+		"usr/lib/plugin.so":                     {ModTime: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	stale := func() string {
+		w := &strings.Builder{}
+		if err := Pkgtrim(w, rootfs, []string{"-stale=90d", "-columns=lastused"}); err != nil {
+			return "error: " + err.Error()
+		}
+		return w.String()
+	}
+	et.Expect("unused", stale(), "2024-01-01 app                      \n")
+	rootfs["usr/lib/plugin.so"].ModTime = time.Date(2024, 8, 1, 0, 0, 0, 0, time.UTC)
+	et.Expect("plugin used", stale(), "No stale unintentional packages found.\n")
+}
+
 func TestMain(m *testing.M) {
 	os.Exit(efftesting.Main(m))
 }
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"cmp"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The reports Pkgtrim computes, the renderers below print them in the various output formats.
+// In JSON the sizes are in bytes, the dates are in RFC 3339 format.
+type (
+	// TopLevelEntry is a line of the no args listing: an unintentional top level package or dependency cycle.
+	TopLevelEntry struct {
+		Name        string    `json:"name"`
+		Packages    []string  `json:"packages"` // the packages of the cycle, just the package itself if it isn't part of a cycle
+		Desc        string    `json:"desc"`
+		UniqueSize  int64     `json:"unique_size"`
+		InstallDate time.Time `json:"install_date,omitzero"`
+		LastUsed    time.Time `json:"last_used,omitzero"` // only with -stale
+		Foreign     bool      `json:"foreign,omitempty"`
+		TotalSize   int64     `json:"total_size"` // the size of all the packages it depends on directly or indirectly including itself
+		Deps        int       `json:"deps"`       // the number of packages it depends on directly or indirectly
+		Version     string    `json:"version,omitempty"`
+		Reason      Reason    `json:"reason"`
+		SharedWith  int       `json:"shared_with"` // the number of the other top level and intentional packages that share some of its dependencies
+	}
+
+	// PackageSet is a list of packages along with their total size.
+	PackageSet struct {
+		Size     int64    `json:"size"`
+		Packages []string `json:"packages"`
+	}
+
+	// DependencyReport is the report for a list of packages.
+	DependencyReport struct {
+		Shared             PackageSet `json:"shared"`              // the dependencies that other packages also have
+		Unique             PackageSet `json:"unique"`              // the dependencies unique to the packages
+		IntentionalRdeps   []string   `json:"intentional_rdeps"`   // the top level rdeps that are present in .pkgtrim
+		UnintentionalRdeps []string   `json:"unintentional_rdeps"` // the top level rdeps that are not present in .pkgtrim
+		OptionallyUsedBy   []string   `json:"optionally_used_by"`  // the packages outside the unique set that optionally depend on it
+		SharedWith         int        `json:"shared_with"`         // the number of the top level and intentional packages outside the dependencies that share some of them
+	}
+
+	// TraceResult is the dependency graph between two packages.
+	TraceResult struct {
+		Src           string      `json:"src"`
+		Dst           string      `json:"dst"`
+		Paths         [][]string  `json:"paths"`          // the dependency chains from Src to Dst
+		OptionalEdges [][2]string `json:"optional_edges"` // the edges of Paths that are optional dependencies
+	}
+
+	// DependencyGraph is the graph of the dependencies and the reverse dependencies of some packages.
+	DependencyGraph struct {
+		Packages      []string    `json:"packages"`       // the packages the graph is about
+		Edges         [][2]string `json:"edges"`          // the dependency edges from the packages to their dependencies
+		OptionalEdges [][2]string `json:"optional_edges"` // the edges that are optional dependencies
+	}
+
+	// configEntry is an entry of .pkgtrim in the -dump_config output.
+	configEntry struct {
+		Entry   string `json:"entry"`
+		Comment string `json:"comment,omitempty"`
+	}
+)
+
+// The reports of the queries such as -why and -owns.
+// They support only the text and the JSON formats so Pkgtrim prints them directly.
+type (
+	// ExplicitReport is the -explicit report: the install reasons that disagree with .pkgtrim.
+	ExplicitReport struct {
+		Explicit     []string `json:"explicit"`     // the explicitly installed but unintentional packages
+		Dependencies []string `json:"dependencies"` // the intentional packages installed as dependencies
+	}
+
+	// FileEntry is a file of the -files and -unowned listings.
+	FileEntry struct {
+		Path    string `json:"path"`
+		Size    int64  `json:"size"`              // the size of the whole directory for the directories
+		Dir     bool   `json:"dir,omitempty"`     // only -unowned lists directories, as a whole
+		Missing bool   `json:"missing,omitempty"` // only -files lists missing files: the package lists them but they are not on the disk
+	}
+
+	// FileList is the -files and -unowned report.
+	FileList struct {
+		Files     []FileEntry `json:"files"`
+		TotalSize int64       `json:"total_size"`
+	}
+
+	// OwnsEntry is the -owns report of a file.
+	OwnsEntry struct {
+		Path        string   `json:"path"`
+		Owners      []string `json:"owners"`      // empty if no package owns the file
+		Intentional []string `json:"intentional"` // the intentional packages keeping the owners installed
+		TopLevel    []string `json:"toplevel"`    // the unintentional top level packages keeping the owners installed
+	}
+
+	// WhyChain is a shortest dependency chain from a root package to the -why argument.
+	WhyChain struct {
+		Packages []string `json:"packages"`
+		Comment  string   `json:"comment,omitempty"` // the .pkgtrim comment of the root
+	}
+
+	// WhyReport is the -why report.
+	WhyReport struct {
+		Package     string     `json:"package"`
+		Intentional []WhyChain `json:"intentional"` // the chains from the intentional packages
+		TopLevel    []WhyChain `json:"toplevel"`    // the chains from the unintentional top level packages
+	}
+
+	// DominatorNode is a package in the -dominators tree.
+	DominatorNode struct {
+		Name     string          `json:"name"`
+		Size     int64           `json:"size"`     // the total size of the subtree
+		Children []DominatorNode `json:"children"` // the packages only this package keeps installed, ordered by size
+	}
+
+	// WhatifReport is the -whatif report.
+	WhatifReport struct {
+		Unintentional []string   `json:"unintentional"` // the packages that are no longer intentional
+		Intentional   []string   `json:"intentional"`   // the packages that become intentional
+		Orphans       PackageSet `json:"orphans"`       // the packages that are no longer kept, -remove would remove them
+		NewlyKept     PackageSet `json:"newly_kept"`    // the packages that become kept
+		Reclaimed     int64      `json:"reclaimed"`     // the size of the orphans minus the size of the newly kept packages
+	}
+)
+
+// Renderer prints the reports in a specific output format.
+type Renderer interface {
+	TopLevel(w io.Writer, entries []TopLevelEntry) error
+	Dependencies(w io.Writer, report DependencyReport) error
+	Trace(w io.Writer, trace TraceResult) error
+	Graph(w io.Writer, graph DependencyGraph) error
+}
+
+// NewRenderer returns the renderer of the -format flag.
+// The text renderer needs to know the listing's columns and units.
+func NewRenderer(format string, text textRenderer) (Renderer, error) {
+	switch format {
+	case "text":
+		return text, nil
+	case "json":
+		return jsonRenderer{}, nil
+	case "csv":
+		return csvRenderer{}, nil
+	case "dot":
+		return dotRenderer{}, nil
+	}
+	return nil, fmt.Errorf("invalid -format=%s, want text, json, csv, or dot", format)
+}
+
+// textRenderer prints the human readable output.
+// The traces and the graphs are in graphviz's format because that's the most readable form of a graph.
+type textRenderer struct {
+	units   string   // the unit of the sizes, see formatSize
+	columns []string // the columns of the listing before the name and the description, see listingColumns
+	stale   bool     // whether the listing contains only the stale packages
+}
+
+// listingColumns are the columns the no args listing can print before the name and the description.
+var listingColumns = []string{"unique", "total", "deps", "sharedwith", "installed", "lastused", "version", "reason", "foreign"}
+
+func (r textRenderer) TopLevel(w io.Writer, entries []TopLevelEntry) error {
+	if len(entries) == 0 && r.stale {
+		fmt.Fprintln(w, "No stale unintentional packages found.")
+		return nil
+	}
+	if len(entries) == 0 {
+		fmt.Fprintln(w, "No unintenional packages found. Use `-f /dev/null` to print all.")
+		return nil
+	}
+	for _, e := range entries {
+		for _, column := range r.columns {
+			switch column {
+			case "unique":
+				fmt.Fprintf(w, "%s ", formatSize(e.UniqueSize, r.units))
+			case "total":
+				fmt.Fprintf(w, "%s ", formatSize(e.TotalSize, r.units))
+			case "deps":
+				fmt.Fprintf(w, "%5d ", e.Deps)
+			case "sharedwith":
+				fmt.Fprintf(w, "%5d ", e.SharedWith)
+			case "installed":
+				fmt.Fprintf(w, "%-10s ", formatDate(e.InstallDate))
+			case "lastused":
+				fmt.Fprintf(w, "%-10s ", formatDate(e.LastUsed))
+			case "version":
+				fmt.Fprintf(w, "%-20s ", cmp.Or(e.Version, "-"))
+			case "reason":
+				fmt.Fprintf(w, "%-10s ", e.Reason)
+			case "foreign":
+				foreign := ""
+				if e.Foreign {
+					foreign = "foreign"
+				}
+				fmt.Fprintf(w, "%-7s ", foreign)
+			}
+		}
+		fmt.Fprintf(w, "%-24s %s\n", strings.Join(e.Packages, ","), e.Desc)
+	}
+	return nil
+}
+
+func (r textRenderer) Dependencies(w io.Writer, report DependencyReport) error {
+	fmt.Fprintf(w, "shared dependencies (%s): %s\n\n", formatSize(report.Shared.Size, r.units), strings.Join(report.Shared.Packages, " "))
+	fmt.Fprintf(w, "unique dependencies (%s): %s\n\n", formatSize(report.Unique.Size, r.units), strings.Join(report.Unique.Packages, " "))
+	total := len(report.Shared.Packages) + len(report.Unique.Packages)
+	fmt.Fprintf(w, "total dependencies (%s): %d packages, shared with %d top level or intentional packages\n\n", formatSize(report.Shared.Size+report.Unique.Size, r.units), total, report.SharedWith)
+	fmt.Fprintf(w, "intentional top level rdeps: %s\n\n", strings.Join(report.IntentionalRdeps, " "))
+	fmt.Fprintf(w, "unintentional top level rdeps: %s\n\n", strings.Join(report.UnintentionalRdeps, " "))
+	if len(report.OptionallyUsedBy) > 0 {
+		fmt.Fprintf(w, "optionally used by: %s\n\n", strings.Join(report.OptionallyUsedBy, " "))
+	}
+	return nil
+}
+
+func (r textRenderer) Trace(w io.Writer, trace TraceResult) error {
+	return dotRenderer{}.Trace(w, trace)
+}
+
+func (r textRenderer) Graph(w io.Writer, graph DependencyGraph) error {
+	return dotRenderer{}.Graph(w, graph)
+}
+
+// jsonRenderer prints the reports as indented JSON.
+type jsonRenderer struct{}
+
+func (jsonRenderer) TopLevel(w io.Writer, entries []TopLevelEntry) error {
+	// Print the dates in UTC like the other formats, the package systems might return them in the local time zone.
+	utc := make([]TopLevelEntry, len(entries))
+	for i, e := range entries {
+		e.InstallDate, e.LastUsed = e.InstallDate.UTC(), e.LastUsed.UTC()
+		utc[i] = e
+	}
+	return writeJSON(w, utc)
+}
+
+func (jsonRenderer) Dependencies(w io.Writer, report DependencyReport) error {
+	return writeJSON(w, report)
+}
+
+func (jsonRenderer) Trace(w io.Writer, trace TraceResult) error {
+	return writeJSON(w, trace)
+}
+
+func (jsonRenderer) Graph(w io.Writer, graph DependencyGraph) error {
+	return writeJSON(w, graph)
+}
+
+// writeJSON writes v as indented JSON.
+func writeJSON(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(v)
+}
+
+// csvRenderer prints the reports as CSV with a header line.
+// The lists of packages are space separated.
+type csvRenderer struct{}
+
+func (csvRenderer) TopLevel(w io.Writer, entries []TopLevelEntry) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"name", "packages", "desc", "unique_size", "install_date", "last_used", "foreign", "total_size", "deps", "version", "reason", "shared_with"})
+	for _, e := range entries {
+		cw.Write([]string{e.Name, strings.Join(e.Packages, " "), e.Desc, strconv.FormatInt(e.UniqueSize, 10), csvDate(e.InstallDate), csvDate(e.LastUsed), strconv.FormatBool(e.Foreign), strconv.FormatInt(e.TotalSize, 10), strconv.Itoa(e.Deps), e.Version, e.Reason.String(), strconv.Itoa(e.SharedWith)})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func (csvRenderer) Dependencies(w io.Writer, report DependencyReport) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"category", "package"})
+	for _, category := range []struct {
+		name string
+		pkgs []string
+	}{
+		{"shared", report.Shared.Packages},
+		{"unique", report.Unique.Packages},
+		{"intentional_rdep", report.IntentionalRdeps},
+		{"unintentional_rdep", report.UnintentionalRdeps},
+		{"optionally_used_by", report.OptionallyUsedBy},
+	} {
+		for _, pkg := range category.pkgs {
+			cw.Write([]string{category.name, pkg})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func (csvRenderer) Trace(w io.Writer, trace TraceResult) error {
+	optional := make(map[[2]string]bool, len(trace.OptionalEdges))
+	for _, edge := range trace.OptionalEdges {
+		optional[edge] = true
+	}
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"from", "to", "optional"})
+	printed := map[[2]string]bool{}
+	for _, path := range trace.Paths {
+		for k := 1; k < len(path); k++ {
+			edge := [2]string{path[k-1], path[k]}
+			if !printed[edge] {
+				printed[edge] = true
+				cw.Write([]string{edge[0], edge[1], strconv.FormatBool(optional[edge])})
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func (csvRenderer) Graph(w io.Writer, graph DependencyGraph) error {
+	optional := make(map[[2]string]bool, len(graph.OptionalEdges))
+	for _, edge := range graph.OptionalEdges {
+		optional[edge] = true
+	}
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"from", "to", "optional"})
+	for _, edge := range graph.Edges {
+		cw.Write([]string{edge[0], edge[1], strconv.FormatBool(optional[edge])})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// csvDate formats t in RFC 3339 or returns an empty string for the zero time.
+func csvDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// dotRenderer prints the graphs in graphviz's format.
+// Pipe the output to 'dot -Tx11' to visualize it.
+type dotRenderer struct{}
+
+func (dotRenderer) TopLevel(w io.Writer, entries []TopLevelEntry) error {
+	return fmt.Errorf("-format=dot supports only -trace and -graph")
+}
+
+func (dotRenderer) Dependencies(w io.Writer, report DependencyReport) error {
+	return fmt.Errorf("-format=dot supports only -trace and -graph")
+}
+
+func (dotRenderer) Trace(w io.Writer, trace TraceResult) error {
+	optional := make(map[[2]string]bool, len(trace.OptionalEdges))
+	for _, edge := range trace.OptionalEdges {
+		optional[edge] = true
+	}
+	fmt.Fprintf(w, "strict digraph {\n  \"%s\" [style=filled fillcolor=lightgray]\n  \"%s\" [style=filled fillcolor=lightgray]\n", trace.Src, trace.Dst)
+	for _, path := range trace.Paths {
+		// Print the path as chains, the optional dependency edges separately because they are dashed.
+		chain := []string{path[0]}
+		for k := 1; k < len(path); k++ {
+			if optional[[2]string{path[k-1], path[k]}] {
+				if len(chain) > 1 {
+					fmt.Fprintf(w, "  \"%s\"\n", strings.Join(chain, "\" -> \""))
+				}
+				fmt.Fprintf(w, "  \"%s\" -> \"%s\" [style=dashed]\n", path[k-1], path[k])
+				chain = chain[:0]
+			}
+			chain = append(chain, path[k])
+		}
+		if len(chain) > 1 || len(path) == 1 {
+			fmt.Fprintf(w, "  \"%s\"\n", strings.Join(chain, "\" -> \""))
+		}
+	}
+	fmt.Fprintln(w, "}")
+	return nil
+}
+
+func (dotRenderer) Graph(w io.Writer, graph DependencyGraph) error {
+	optional := make(map[[2]string]bool, len(graph.OptionalEdges))
+	for _, edge := range graph.OptionalEdges {
+		optional[edge] = true
+	}
+	fmt.Fprintln(w, "digraph {")
+	for _, pkg := range graph.Packages {
+		fmt.Fprintf(w, "  \"%s\" [style=filled fillcolor=lightgray]\n", pkg)
+	}
+	for _, edge := range graph.Edges {
+		if optional[edge] {
+			fmt.Fprintf(w, "  \"%s\" -> \"%s\" [style=dashed]\n", edge[0], edge[1])
+		} else {
+			fmt.Fprintf(w, "  \"%s\" -> \"%s\"\n", edge[0], edge[1])
+		}
+	}
+	fmt.Fprintln(w, "}")
+	return nil
+}
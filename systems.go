@@ -1,19 +1,67 @@
 package main
 
 import (
+	"archive/tar"
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
+	"maps"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 // Package describes a single installed package.
 type Package struct {
-	Name string   // name of the package
-	Desc string   // human description of the package
-	Size int64    // size of the package in bytes
-	Deps []string // list of other packages this package depends on; resolved packages only, no virtual packages here
+	Name        string    `json:"name"`                  // name of the package
+	Desc        string    `json:"desc"`                  // human description of the package
+	Size        int64     `json:"size"`                  // size of the package in bytes
+	Deps        []string  `json:"deps,omitempty"`        // list of other packages this package depends on; resolved packages only, no virtual packages here
+	OptDeps     []string  `json:"optdeps,omitempty"`     // list of other installed packages this package optionally depends on; not present in Deps
+	Reason      Reason    `json:"reason"`                // why the package manager thinks the package is installed
+	Foreign     bool      `json:"foreign,omitempty"`     // no configured repository provides the package, e.g. it was built manually or comes from the AUR
+	Version     string    `json:"version,omitempty"`     // version of the package, empty if unknown
+	Arch        string    `json:"arch,omitempty"`        // architecture of the package, empty if unknown
+	Packager    string    `json:"packager,omitempty"`    // who built the package, empty if unknown
+	InstallDate time.Time `json:"install_date,omitzero"` // when the package was installed, zero if unknown
+	BuildDate   time.Time `json:"build_date,omitzero"`   // when the package was built, zero if unknown
+}
+
+// Reason is why the package manager thinks a package is installed.
+type Reason int8
+
+const (
+	ReasonUnknown    Reason = iota // the package system doesn't track the reason
+	ReasonExplicit                 // the user installed the package explicitly
+	ReasonDependency               // the package was installed as a dependency of another package
+)
+
+func (r Reason) String() string {
+	switch r {
+	case ReasonExplicit:
+		return "explicit"
+	case ReasonDependency:
+		return "dependency"
+	}
+	return "unknown"
+}
+
+// MarshalText implements encoding.TextMarshaler for the -format=json output.
+func (r Reason) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
 }
 
 // PackageSystem is the interface that various package managers must implement.
@@ -21,46 +69,405 @@ type PackageSystem interface {
 	// Packages returns all the installed packages in the system.
 	Packages() ([]Package, error)
 
-	// Remove generates a command that removes the specified packages.
-	Remove(pkgs []string) []string
+	// Remove generates the commands that remove the specified packages.
+	Remove(pkgs []string) [][]string
 
-	// Remove generates a command that installs the specified packages.
-	Install(pkgs []string) []string
+	// Install generates the commands that install the specified packages.
+	Install(pkgs []string) [][]string
+}
+
+// Marker is implemented by the package systems that can change the install reason of the packages.
+type Marker interface {
+	// Mark generates the commands that mark the packages as explicitly installed or as installed as a dependency.
+	Mark(explicit, deps []string) [][]string
+}
+
+// Catalogue is implemented by the package systems that know which packages their configured repositories provide.
+type Catalogue interface {
+	// Available returns the packages from the configured repositories matching each of the package names or globs.
+	// The patterns the package system can't tell about, e.g. because the repositories were never synced, are missing from the result.
+	Available(patterns []string) (map[string][]string, error)
+}
+
+// FileLister is implemented by the package systems that track the files of the packages.
+type FileLister interface {
+	// Files returns the files and directories of the package relative to the root.
+	Files(pkg Package) ([]string, error)
 }
 
 // NewPackageSystem creates a new PackageSystem based on the files found in the passed in filesystem.
+// If Flatpak or Snap is also present then it returns a composite PackageSystem that contains their packages too.
 func NewPackageSystem(rootfs fs.FS) (PackageSystem, error) {
+	c := composite{}
+	if system, err := newDistroSystem(rootfs); err == nil {
+		c.systems, c.prefixes, c.managers = append(c.systems, system), append(c.prefixes, ""), append(c.managers, "")
+	}
+	if _, err := fs.Stat(rootfs, "var/lib/flatpak"); err == nil {
+		c.systems, c.prefixes, c.managers = append(c.systems, flatpak{rootfs}), append(c.prefixes, flatpakPrefix), append(c.managers, "flatpak")
+	}
+	if _, err := fs.Stat(rootfs, "var/lib/snapd/state.json"); err == nil {
+		c.systems, c.prefixes, c.managers = append(c.systems, snap{rootfs}), append(c.prefixes, snapPrefix), append(c.managers, "snapd")
+	}
+	switch {
+	case len(c.systems) == 0:
+		return nil, fmt.Errorf("no supported system detected")
+	case len(c.systems) == 1 && c.prefixes[0] == "":
+		return c.systems[0], nil
+	}
+	return c, nil
+}
+
+// newDistroSystem detects the distribution's package manager.
+func newDistroSystem(rootfs fs.FS) (PackageSystem, error) {
 	if _, err := fs.Stat(rootfs, "var/lib/pacman/local"); err == nil {
-		return archlinux{rootfs}, nil
+		s := archlinux{rootfs: rootfs}
+		s.syncdb = sync.OnceValues(s.loadSyncDB)
+		return s, nil
 	}
 	if _, err := fs.Stat(rootfs, "var/lib/dpkg/status"); err == nil {
 		return debian{rootfs}, nil
 	}
+	if _, err := fs.Stat(rootfs, "usr/lib/opkg/status"); err == nil {
+		return opkg{rootfs}, nil
+	}
+	if _, err := fs.Stat(rootfs, "lib/apk/db/installed"); err == nil {
+		return alpine{rootfs}, nil
+	}
+	if pkgdbs, _ := fs.Glob(rootfs, "var/db/xbps/pkgdb-*.plist"); len(pkgdbs) > 0 {
+		return void{rootfs, pkgdbs[len(pkgdbs)-1]}, nil
+	}
+	if _, err := fs.Stat(rootfs, "var/db/pkg"); err == nil {
+		return gentoo{rootfs}, nil
+	}
+	for _, dir := range []string{rpmManifest, "var/lib/rpm", "usr/lib/sysimage/rpm"} {
+		if _, err := fs.Stat(rootfs, dir); err == nil {
+			tool := "dnf"
+			if _, err := fs.Stat(rootfs, "usr/bin/zypper"); err == nil {
+				tool = "zypper"
+			}
+			return rpm{rootfs, tool}, nil
+		}
+	}
 	return nil, fmt.Errorf("no supported system detected")
 }
 
 type archlinux struct {
 	rootfs fs.FS
+	syncdb func() (archSyncDB, error) // loads the sync databases only once, both Packages and Available need them
+}
+
+// archSyncDB is what pkgtrim needs from pacman's sync databases.
+type archSyncDB struct {
+	names    []string        // the sorted names of the packages, nil if the databases were never synced
+	provided map[string]bool // the virtual package names from %PROVIDES% and the group names from %GROUPS%
 }
 
 type debian struct {
 	rootfs fs.FS
 }
 
-func (s archlinux) Remove(pkgs []string) []string {
-	return append([]string{"sudo", "pacman", "-R"}, pkgs...)
+type opkg struct {
+	rootfs fs.FS
+}
+
+type alpine struct {
+	rootfs fs.FS
+}
+
+type rpm struct {
+	rootfs fs.FS
+	tool   string // the frontend to generate the commands for: dnf or zypper
+}
+
+type gentoo struct {
+	rootfs fs.FS
+}
+
+type void struct {
+	rootfs fs.FS
+	pkgdb  string // the path to the xbps package database
+}
+
+type flatpak struct {
+	rootfs fs.FS
+}
+
+type snap struct {
+	rootfs fs.FS
+}
+
+// The name prefixes of the packages from the non-distribution package systems.
+const (
+	flatpakPrefix = "flatpak:"
+	snapPrefix    = "snap:"
+)
+
+// composite merges the packages from multiple package systems.
+// The names of the packages from the systems with a non-empty prefix start with that prefix.
+// The commands are routed to the systems based on these prefixes.
+type composite struct {
+	systems  []PackageSystem
+	prefixes []string // the name prefix of each system, empty for the distribution's package system
+	managers []string // the distribution's package that manages each system's packages, empty for the distribution's package system
+}
+
+// rpmManifest is the exported package list the rpm backend reads instead of the rpm database.
+// Generate it with `rpm -qa --queryformat "$rpmQueryformat"`.
+// If it doesn't exist and the root is the real filesystem then pkgtrim runs that command itself.
+const rpmManifest = "var/lib/pkgtrim/rpm.manifest"
+
+// rpmQueryformat makes rpm print the installed packages in a dpkg status-like format.
+// The File entries are needed to resolve the dependencies on paths such as /bin/sh.
+const rpmQueryformat = `Name: %{NAME}\nArch: %{ARCH}\nSummary: %{SUMMARY}\nSize: %{SIZE}\n[Requires: %{REQUIRENAME}\n][Provides: %{PROVIDENAME}\n][File: %{FILENAMES}\n]\n`
+
+func (s archlinux) Remove(pkgs []string) [][]string {
+	return [][]string{append([]string{"sudo", "pacman", "-R"}, pkgs...)}
+}
+
+func (s archlinux) Install(pkgs []string) [][]string {
+	return [][]string{append([]string{"sudo", "pacman", "-S"}, pkgs...)}
+}
+
+func (s archlinux) Mark(explicit, deps []string) [][]string {
+	var cmds [][]string
+	if len(explicit) > 0 {
+		cmds = append(cmds, append([]string{"sudo", "pacman", "-D", "--asexplicit"}, explicit...))
+	}
+	if len(deps) > 0 {
+		cmds = append(cmds, append([]string{"sudo", "pacman", "-D", "--asdeps"}, deps...))
+	}
+	return cmds
+}
+
+func (s debian) Remove(pkgs []string) [][]string {
+	return [][]string{append([]string{"sudo", "apt", "remove"}, pkgs...)}
+}
+
+func (s debian) Install(pkgs []string) [][]string {
+	return [][]string{append([]string{"sudo", "apt", "install"}, pkgs...)}
+}
+
+func (s debian) Mark(explicit, deps []string) [][]string {
+	var cmds [][]string
+	if len(explicit) > 0 {
+		cmds = append(cmds, append([]string{"sudo", "apt-mark", "manual"}, explicit...))
+	}
+	if len(deps) > 0 {
+		cmds = append(cmds, append([]string{"sudo", "apt-mark", "auto"}, deps...))
+	}
+	return cmds
+}
+
+func (s opkg) Remove(pkgs []string) [][]string {
+	return [][]string{append([]string{"opkg", "remove"}, pkgs...)}
+}
+
+func (s opkg) Install(pkgs []string) [][]string {
+	return [][]string{append([]string{"opkg", "install"}, pkgs...)}
+}
+
+func (s alpine) Remove(pkgs []string) [][]string {
+	return [][]string{append([]string{"sudo", "apk", "del"}, pkgs...)}
+}
+
+func (s alpine) Install(pkgs []string) [][]string {
+	return [][]string{append([]string{"sudo", "apk", "add"}, pkgs...)}
+}
+
+func (s rpm) Remove(pkgs []string) [][]string {
+	return [][]string{append([]string{"sudo", s.tool, "remove"}, pkgs...)}
+}
+
+func (s rpm) Install(pkgs []string) [][]string {
+	return [][]string{append([]string{"sudo", s.tool, "install"}, pkgs...)}
+}
+
+// Remove first removes the packages from @world because --depclean refuses to remove the packages in it.
+// The packages are passed to --depclean too, otherwise it would remove all the other orphans as well.
+func (s gentoo) Remove(pkgs []string) [][]string {
+	return [][]string{append([]string{"sudo", "emerge", "--deselect"}, pkgs...), append([]string{"sudo", "emerge", "--depclean"}, pkgs...)}
+}
+
+func (s gentoo) Install(pkgs []string) [][]string {
+	return [][]string{append([]string{"sudo", "emerge", "--noreplace"}, pkgs...)}
+}
+
+func (s void) Remove(pkgs []string) [][]string {
+	return [][]string{append([]string{"sudo", "xbps-remove"}, pkgs...)}
+}
+
+func (s void) Install(pkgs []string) [][]string {
+	return [][]string{append([]string{"sudo", "xbps-install"}, pkgs...)}
+}
+
+func (s flatpak) Remove(pkgs []string) [][]string {
+	return [][]string{append([]string{"flatpak", "uninstall"}, trimPrefixes(pkgs, flatpakPrefix)...)}
+}
+
+func (s flatpak) Install(pkgs []string) [][]string {
+	return [][]string{append([]string{"flatpak", "install"}, trimPrefixes(pkgs, flatpakPrefix)...)}
+}
+
+func (s snap) Remove(pkgs []string) [][]string {
+	return [][]string{append([]string{"sudo", "snap", "remove"}, trimPrefixes(pkgs, snapPrefix)...)}
+}
+
+func (s snap) Install(pkgs []string) [][]string {
+	return [][]string{append([]string{"sudo", "snap", "install"}, trimPrefixes(pkgs, snapPrefix)...)}
+}
+
+// trimPrefixes removes the prefix from each package name.
+func trimPrefixes(pkgs []string, prefix string) []string {
+	trimmed := make([]string, len(pkgs))
+	for i, pkg := range pkgs {
+		trimmed[i] = strings.TrimPrefix(pkg, prefix)
+	}
+	return trimmed
+}
+
+func (s composite) Packages() ([]Package, error) {
+	var pkgs []Package
+	systemOf := make([]int, 0, 1e4) // the index of the system of each package
+	for i, system := range s.systems {
+		p, err := system.Packages()
+		if err != nil {
+			if s.prefixes[i] == "" {
+				return nil, err
+			}
+			return nil, fmt.Errorf("load %s packages: %v", strings.TrimSuffix(s.prefixes[i], ":"), err)
+		}
+		pkgs = append(pkgs, p...)
+		for range p {
+			systemOf = append(systemOf, i)
+		}
+	}
+
+	// The packages can't be managed without their manager so make them depend on it.
+	// This way removing the manager removes its packages too.
+	installed := map[string]bool{}
+	for i, pkg := range pkgs {
+		if s.prefixes[systemOf[i]] == "" {
+			installed[pkg.Name] = true
+		}
+	}
+	for i := range pkgs {
+		if manager := s.managers[systemOf[i]]; installed[manager] {
+			pkgs[i].Deps = append(pkgs[i].Deps, manager)
+			slices.Sort(pkgs[i].Deps)
+		}
+	}
+	return pkgs, nil
+}
+
+// systemOf returns the index of the system the package belongs to.
+// The names without a prefix belong to the distribution's package system.
+func (s composite) systemOf(pkg string) (int, error) {
+	for i, prefix := range s.prefixes {
+		if prefix != "" && strings.HasPrefix(pkg, prefix) {
+			return i, nil
+		}
+	}
+	if i := slices.Index(s.prefixes, ""); i != -1 {
+		return i, nil
+	}
+	return 0, fmt.Errorf("%s has no %s prefix and no distribution package system found", pkg, strings.Join(s.prefixes, " or "))
+}
+
+// split groups the packages by the system they belong to.
+// The packages without a system are left out and reported in the error.
+func (s composite) split(pkgs []string) ([][]string, error) {
+	groups, errs := make([][]string, len(s.systems)), []error(nil)
+	for _, pkg := range pkgs {
+		i, err := s.systemOf(pkg)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		groups[i] = append(groups[i], pkg)
+	}
+	return groups, errors.Join(errs...)
+}
+
+func (s composite) Files(pkg Package) ([]string, error) {
+	i, err := s.systemOf(pkg.Name)
+	if err != nil {
+		return nil, err
+	}
+	if lister, ok := s.systems[i].(FileLister); ok {
+		return lister.Files(pkg)
+	}
+	return nil, nil
+}
+
+// Remove removes the distribution's packages last because that might remove the tools the other systems need.
+// Removing such a tool removes all the packages it manages because nothing could remove them afterwards.
+func (s composite) Remove(pkgs []string) [][]string {
+	var cmds, distrocmds [][]string
+	groups, _ := s.split(pkgs) // the installed packages always belong to a system
+	for i, manager := range s.managers {
+		if manager == "" || !slices.Contains(pkgs, manager) {
+			continue
+		}
+		if managed, err := s.systems[i].Packages(); err == nil {
+			groups[i] = groups[i][:0]
+			for _, pkg := range managed {
+				groups[i] = append(groups[i], pkg.Name)
+			}
+			slices.Sort(groups[i])
+		}
+	}
+	for i, group := range groups {
+		switch {
+		case len(group) == 0:
+		case s.prefixes[i] == "":
+			distrocmds = s.systems[i].Remove(group)
+		default:
+			cmds = append(cmds, s.systems[i].Remove(group)...)
+		}
+	}
+	return append(cmds, distrocmds...)
 }
 
-func (s archlinux) Install(pkgs []string) []string {
-	return append([]string{"sudo", "pacman", "-S"}, pkgs...)
+func (s composite) Install(pkgs []string) [][]string {
+	var cmds [][]string
+	groups, _ := s.split(pkgs) // Available already reported the packages without a system
+	for i, group := range groups {
+		if len(group) > 0 {
+			cmds = append(cmds, s.systems[i].Install(group)...)
+		}
+	}
+	return cmds
 }
 
-func (s debian) Remove(pkgs []string) []string {
-	return append([]string{"sudo", "apt", "remove"}, pkgs...)
+func (s composite) Available(patterns []string) (map[string][]string, error) {
+	available := map[string][]string{}
+	groups, err := s.split(patterns)
+	if err != nil {
+		return nil, err
+	}
+	for i, group := range groups {
+		if catalogue, ok := s.systems[i].(Catalogue); ok && len(group) > 0 {
+			m, err := catalogue.Available(group)
+			if err != nil {
+				return nil, err
+			}
+			maps.Copy(available, m)
+		}
+	}
+	return available, nil
 }
 
-func (s debian) Install(pkgs []string) []string {
-	return append([]string{"sudo", "apt", "install"}, pkgs...)
+func (s composite) Mark(explicit, deps []string) [][]string {
+	var cmds [][]string
+	// The installed packages always belong to a system.
+	explicitgroups, _ := s.split(explicit)
+	depsgroups, _ := s.split(deps)
+	for i, system := range s.systems {
+		if marker, ok := system.(Marker); ok && len(explicitgroups[i])+len(depsgroups[i]) > 0 {
+			cmds = append(cmds, marker.Mark(explicitgroups[i], depsgroups[i])...)
+		}
+	}
+	return cmds
 }
 
 func (s archlinux) Packages() ([]Package, error) {
@@ -73,9 +480,10 @@ func (s archlinux) Packages() ([]Package, error) {
 	}
 
 	var (
-		pkgs     = make([]Package, 0, 1e4)      // the return value
-		depends  = make([]string, 0, 1e4)       // the depends section for each package
-		provider = make(map[string]string, 1e4) // for tracking virtual packages
+		pkgs       = make([]Package, 0, 1e4)      // the return value
+		depends    = make([]string, 0, 1e4)       // the depends section for each package
+		optdepends = make([]string, 0, 1e4)       // the optdepends section for each package
+		provider   = make(map[string]string, 1e4) // for tracking virtual packages
 	)
 
 	for _, file := range pkgfiles {
@@ -84,7 +492,8 @@ func (s archlinux) Packages() ([]Package, error) {
 			return nil, err
 		}
 
-		var pkg Package
+		// pacman omits %REASON% for the explicitly installed packages.
+		pkg, optdepend := Package{Reason: ReasonExplicit}, ""
 		for _, entry := range strings.Split("\n"+string(desc), "\n%") {
 			if entry == "" {
 				continue
@@ -105,11 +514,27 @@ func (s archlinux) Packages() ([]Package, error) {
 				pkg.Desc, _, _ = strings.Cut(value, "\n")
 			case "SIZE":
 				pkg.Size, _ = strconv.ParseInt(value, 10, 64)
+			case "VERSION":
+				pkg.Version = value
+			case "ARCH":
+				pkg.Arch = value
+			case "PACKAGER":
+				pkg.Packager = value
+			case "INSTALLDATE":
+				pkg.InstallDate = parseUnixTime(value)
+			case "BUILDDATE":
+				pkg.BuildDate = parseUnixTime(value)
+			case "REASON":
+				if value == "1" {
+					pkg.Reason = ReasonDependency
+				}
 			case "DEPENDS":
 				if len(pkgs) != len(depends) {
 					return nil, fmt.Errorf("parse %s: double DEPENDS section", file)
 				}
 				depends = append(depends, value)
+			case "OPTDEPENDS":
+				optdepend = value
 			case "PROVIDES":
 				for _, line := range strings.Split(value, "\n") {
 					if line == "" {
@@ -128,7 +553,7 @@ func (s archlinux) Packages() ([]Package, error) {
 		if pkg.Name == "" {
 			return nil, fmt.Errorf("parse %s: no name found", file)
 		}
-		pkgs = append(pkgs, pkg)
+		pkgs, optdepends = append(pkgs, pkg), append(optdepends, optdepend)
 	}
 
 	// Now resolve the dependencies using the provider map.
@@ -151,95 +576,1297 @@ func (s archlinux) Packages() ([]Package, error) {
 		}
 		slices.Sort(deps)
 		pkgs[i].Deps = slices.Clone(slices.Compact(deps))
+
+		// Optional dependencies are recorded only if they are installed.
+		optdeps := deps[:0]
+		for _, d := range strings.Split(optdepends[i], "\n") {
+			// Remove the description and the version bit from instances like "python-pygments: for syntax highlighting".
+			d, _, _ = strings.Cut(d, ":")
+			d, _, _ = strings.Cut(d, "<")
+			d, _, _ = strings.Cut(d, ">")
+			d, _, _ = strings.Cut(d, "=")
+			if p, ok := provider[strings.TrimSpace(d)]; ok && p != pkgs[i].Name && !slices.Contains(pkgs[i].Deps, p) {
+				optdeps = append(optdeps, p)
+			}
+		}
+		slices.Sort(optdeps)
+		pkgs[i].OptDeps = slices.Clone(slices.Compact(optdeps))
+	}
+
+	// The packages missing from the sync databases are foreign.
+	syncdb, err := s.syncdb()
+	if err != nil {
+		return nil, err
+	}
+	if len(syncdb.names) > 0 {
+		for i := range pkgs {
+			_, found := slices.BinarySearch(syncdb.names, pkgs[i].Name)
+			pkgs[i].Foreign = !found
+		}
 	}
 	return pkgs, nil
 }
 
-func (s debian) Packages() ([]Package, error) {
-	statusfile, err := fs.ReadFile(s.rootfs, "var/lib/dpkg/status")
+// Files parses the %FILES% section of the package's files entry.
+func (s archlinux) Files(pkg Package) ([]string, error) {
+	data, err := fs.ReadFile(s.rootfs, "var/lib/pacman/local/"+pkg.Name+"-"+pkg.Version+"/files")
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
 	if err != nil {
 		return nil, err
 	}
+	_, files, _ := strings.Cut(string(data), "%FILES%\n")
+	files, _, _ = strings.Cut(files, "\n\n")
+	paths := strings.Fields(files)
+	for i := range paths {
+		// Remove the trailing slash of the directories.
+		paths[i] = strings.TrimSuffix(paths[i], "/")
+	}
+	return paths, nil
+}
 
-	var (
-		curpkg     Package // the current package that is being parsed
-		curdepends string  // the current package's dependency section
+// parseUnixTime parses a unix timestamp such as pacman's %INSTALLDATE%.
+// Returns the zero time for the missing or invalid timestamps, the rest are in UTC so that the output is the same in every timezone.
+func parseUnixTime(s string) time.Time {
+	sec, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || sec <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0).UTC()
+}
 
-		pkgs     = make([]Package, 0, 1e4)      // the return value
-		depends  = make([]string, 0, 1e4)       // the depends section for each package
-		provider = make(map[string]string, 1e4) // for tracking virtual packages
-	)
+// loadSyncDB reads the sync databases, these are gzipped tarballs of the packages' desc files.
+// pacman can be configured to compress them with zstd or xz too, pkgtrim can't read those.
+// Then it warns and skips all the databases because the packages of a skipped repository would look foreign.
+func (s archlinux) loadSyncDB() (archSyncDB, error) {
+	dbs, err := fs.Glob(s.rootfs, "var/lib/pacman/sync/*.db")
+	if err != nil {
+		return archSyncDB{}, fmt.Errorf("glob /var/lib/pacman/sync/*.db: %v", err)
+	}
+	syncdb := archSyncDB{provided: map[string]bool{}}
+	for _, db := range dbs {
+		if err := syncdb.read(s.rootfs, db); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning, skipping the sync databases, the foreign packages and the repositories are unknown: %v.\n", err)
+			return archSyncDB{}, nil
+		}
+	}
+	slices.Sort(syncdb.names)
+	syncdb.names = slices.Compact(syncdb.names)
+	return syncdb, nil
+}
 
-	for _, line := range strings.Split(string(statusfile), "\n") {
-		if line == "" {
-			if curpkg.Name != "" {
-				pkgs, depends = append(pkgs, curpkg), append(depends, curdepends)
-				provider[curpkg.Name] = curpkg.Name
-			}
-			curpkg, curdepends = Package{}, ""
+// read adds the packages of a sync database.
+func (syncdb *archSyncDB) read(rootfs fs.FS, db string) error {
+	f, err := rootfs.Open(db)
+	if err != nil {
+		return fmt.Errorf("read /%s: %v", db, err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("read /%s: %v", db, err)
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read /%s: %v", db, err)
+		}
+		if path.Base(hdr.Name) != "desc" {
 			continue
 		}
-		key, value, _ := strings.Cut(line, ":")
-		value = strings.TrimSpace(value)
-		switch key {
-		case "Package":
-			curpkg.Name = value
-		case "Description":
-			curpkg.Desc = value
-		case "Installed-Size":
-			curpkg.Size, _ = strconv.ParseInt(value, 10, 64)
-			curpkg.Size *= 1024
-		case "Status":
-			if !strings.HasPrefix(value, "install") {
-				curpkg.Name = ""
-			}
-		case "Provides":
-			if curpkg.Name == "" {
-				break
-			}
-			for _, p := range strings.Split(value, ",") {
-				// Remove the version bit.
-				p, _, _ = strings.Cut(p, "(")
-				provider[strings.TrimSpace(p)] = curpkg.Name
+		desc, err := io.ReadAll(tr)
+		if err != nil {
+			return fmt.Errorf("read /%s: %v", db, err)
+		}
+		name := ""
+		for _, entry := range strings.Split("\n"+string(desc), "\n%") {
+			hdrname, value, _ := strings.Cut(entry, "%\n")
+			switch hdrname {
+			case "NAME":
+				name = strings.TrimSpace(value)
+			case "PROVIDES", "GROUPS":
+				for _, line := range strings.Fields(value) {
+					// Remove the version bit from instances like "libargon2.so=1-64".
+					line, _, _ = strings.Cut(line, "=")
+					syncdb.provided[line] = true
+				}
 			}
-		case "Depends":
-			curdepends = value
 		}
+		if name == "" {
+			return fmt.Errorf("parse /%s/%s: no name found", db, hdr.Name)
+		}
+		syncdb.names = append(syncdb.names, name)
+	}
+}
+
+// Available matches the globs only against the package names.
+// The virtual packages and the groups are available only by their exact name, pacman -S installs them too.
+func (s archlinux) Available(patterns []string) (map[string][]string, error) {
+	syncdb, err := s.syncdb()
+	if err != nil || syncdb.names == nil {
+		return nil, err
 	}
-	if curpkg.Name != "" {
-		pkgs, depends = append(pkgs, curpkg), append(depends, curdepends)
-		provider[curpkg.Name] = curpkg.Name
+	available := matchAvailable(syncdb.names, patterns)
+	for _, pattern := range patterns {
+		if len(available[pattern]) == 0 && syncdb.provided[pattern] {
+			available[pattern] = []string{pattern}
+		}
 	}
+	return available, nil
+}
 
-	// Now resolve the dependencies using the provider map.
-	deps := make([]string, 0, 32)
-	for i := range pkgs {
-		deps := deps
-		for _, depalternatives := range strings.Split(depends[i], ",") {
-			if strings.TrimSpace(depalternatives) == "" {
-				continue
+// matchAvailable matches the package names or globs against the sorted available package names.
+func matchAvailable(names, patterns []string) map[string][]string {
+	available := make(map[string][]string, len(patterns))
+	for _, pattern := range patterns {
+		re := makeRE(pattern)
+		available[pattern] = []string{}
+		for _, name := range names {
+			if re.MatchString(name) {
+				available[pattern] = append(available[pattern], name)
 			}
-			var depprovider string
-			for _, d := range strings.Split(depalternatives, "|") {
-				d = strings.TrimSpace(d)
-				if d == "" {
-					continue
-				}
-				// Cut the version stuff.
-				d, _, _ = strings.Cut(d, "(")
-				d = strings.TrimSuffix(strings.TrimSpace(d), ":any")
-				if p, ok := provider[d]; ok {
-					depprovider = p
-					break
-				}
-			}
-			if depprovider == "" {
-				return nil, fmt.Errorf("resolve %s: no provider found for dependency %s", pkgs[i].Name, depalternatives)
-			}
-			deps = append(deps, depprovider)
 		}
-		slices.Sort(deps)
-		pkgs[i].Deps = slices.Clone(slices.Compact(deps))
+	}
+	return available
+}
+
+// Available uses apt's package lists, these are in the dpkg status format.
+func (s debian) Available(patterns []string) (map[string][]string, error) {
+	lists, err := fs.Glob(s.rootfs, "var/lib/apt/lists/*_Packages")
+	if err != nil {
+		return nil, fmt.Errorf("glob /var/lib/apt/lists/*_Packages: %v", err)
+	}
+	if len(lists) == 0 {
+		return nil, nil
+	}
+	var names []string
+	for _, list := range lists {
+		data, err := fs.ReadFile(s.rootfs, list)
+		if err != nil {
+			return nil, err
+		}
+		for _, stanza := range parseControl(data) {
+			names = append(names, stanza["Package"])
+		}
+	}
+	slices.Sort(names)
+	return matchAvailable(slices.Compact(names), patterns), nil
+}
+
+func (s debian) Packages() ([]Package, error) {
+	statusfile, err := fs.ReadFile(s.rootfs, "var/lib/dpkg/status")
+	if err != nil {
+		return nil, err
+	}
+	stanzas := parseControl(statusfile)
+
+	// apt tracks the automatically installed packages in a separate file.
+	// The packages not mentioned there are installed manually.
+	extstates, err := fs.ReadFile(s.rootfs, "var/lib/apt/extended_states")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		auto := map[string]string{}
+		for _, stanza := range parseControl(extstates) {
+			auto[stanza["Package"]+":"+stanza["Architecture"]] = stanza["Auto-Installed"]
+		}
+		// apt records the Architecture: all packages under the native architecture.
+		native := "all"
+		for _, stanza := range stanzas {
+			if stanza["Package"] == "dpkg" {
+				native = stanza["Architecture"]
+			}
+		}
+		for _, stanza := range stanzas {
+			arch := stanza["Architecture"]
+			if arch == "all" {
+				arch = native
+			}
+			stanza["Auto-Installed"] = cmp.Or(auto[stanza["Package"]+":"+arch], "0")
+		}
+	}
+	pkgs, err := controlPackages(stanzas, 1024)
+	if err != nil {
+		return nil, err
+	}
+
+	// dpkg doesn't record the install time but the mtime of the file list is a good approximation.
+	for i, pkg := range pkgs {
+		if fi, err := fs.Stat(s.rootfs, s.listfile(pkg)); err == nil {
+			pkgs[i].InstallDate = fi.ModTime().UTC()
+		}
+	}
+	return pkgs, nil
+}
+
+// listfile returns the path of the file that lists the package's files.
+// The file list of the Multi-Arch: same packages has the architecture in its name.
+func (s debian) listfile(pkg Package) string {
+	if _, err := fs.Stat(s.rootfs, "var/lib/dpkg/info/"+pkg.Name+".list"); err == nil {
+		return "var/lib/dpkg/info/" + pkg.Name + ".list"
+	}
+	name, _, _ := strings.Cut(pkg.Name, ":")
+	return "var/lib/dpkg/info/" + name + ":" + pkg.Arch + ".list"
+}
+
+func (s debian) Files(pkg Package) ([]string, error) {
+	data, err := fs.ReadFile(s.rootfs, s.listfile(pkg))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, file := range strings.Split(string(data), "\n") {
+		if file = strings.TrimPrefix(file, "/"); file != "" && file != "." {
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+// parseControl parses dpkg style control data such as /var/lib/dpkg/status into stanzas of fields.
+// Only the first line of the multiline fields is kept.
+func parseControl(data []byte) []map[string]string {
+	var (
+		stanzas = make([]map[string]string, 0, 1e4)
+		stanza  = map[string]string{}
+	)
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			if len(stanza) > 0 {
+				stanzas, stanza = append(stanzas, stanza), map[string]string{}
+			}
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			// A continuation line.
+			continue
+		}
+		key, value, _ := strings.Cut(line, ":")
+		stanza[key] = strings.TrimSpace(value)
+	}
+	if len(stanza) > 0 {
+		stanzas = append(stanzas, stanza)
+	}
+	return stanzas
+}
+
+// controlPackages makes packages from the stanzas of a dpkg style status file.
+// sizeunit is the unit of Installed-Size: dpkg uses kibibytes, opkg uses bytes.
+// The install reason comes from the Auto-Installed field, the reason is unknown if it is missing.
+// Packages of a foreign architecture are qualified with their architecture such as "libc6:i386".
+func controlPackages(stanzas []map[string]string, sizeunit int64) ([]Package, error) {
+	var (
+		pkgs       = make([]Package, 0, 1e4)      // the return value
+		arches     = make([]string, 0, 1e4)       // the architecture of each package, empty for the native ones
+		depends    = make([]string, 0, 1e4)       // the depends and pre-depends section for each package
+		recommends = make([]string, 0, 1e4)       // the recommends and suggests section for each package
+		provider   = make(map[string]string, 1e4) // for tracking virtual packages, foreign ones have the :arch suffix
+		foreign    = make([]string, 0, 4)         // the foreign architectures in use
+		native     string                         // the native architecture, the one of dpkg itself
+	)
+
+	for _, stanza := range stanzas {
+		if stanza["Package"] == "dpkg" {
+			native = stanza["Architecture"]
+		}
+	}
+
+	for _, stanza := range stanzas {
+		if status, ok := stanza["Status"]; stanza["Package"] == "" || ok && !strings.HasPrefix(status, "install") {
+			continue
+		}
+		pkg := Package{Name: stanza["Package"], Desc: stanza["Description"], Version: stanza["Version"], Arch: stanza["Architecture"]}
+		pkg.Size, _ = strconv.ParseInt(stanza["Installed-Size"], 10, 64)
+		pkg.Size *= sizeunit
+		pkg.InstallDate = parseUnixTime(stanza["Installed-Time"])
+		switch stanza["Auto-Installed"] {
+		case "":
+		case "1", "yes":
+			pkg.Reason = ReasonDependency
+		default:
+			pkg.Reason = ReasonExplicit
+		}
+		var qualifier string
+		if arch := stanza["Architecture"]; native != "" && arch != native && arch != "all" && arch != "" {
+			qualifier = ":" + arch
+			if !slices.Contains(foreign, arch) {
+				foreign = append(foreign, arch)
+			}
+		}
+		if provides := stanza["Provides"]; provides != "" {
+			for _, p := range strings.Split(provides, ",") {
+				// Remove the version bit.
+				p, _, _ = strings.Cut(p, "(")
+				provider[strings.TrimSpace(p)+qualifier] = pkg.Name + qualifier
+			}
+		}
+		pkg.Name += qualifier
+		pkgs, arches = append(pkgs, pkg), append(arches, strings.TrimPrefix(qualifier, ":"))
+		depends = append(depends, stanza["Depends"]+","+stanza["Pre-Depends"])
+		recommends = append(recommends, stanza["Recommends"]+","+stanza["Suggests"])
+		provider[pkg.Name] = pkg.Name
+	}
+	slices.Sort(foreign)
+
+	// resolve finds the provider for a dependency such as "libc6", "perl:any" or "zlib1g:i386" of a package of the given architecture.
+	resolve := func(d, arch string) (string, bool) {
+		name, qualifier, _ := strings.Cut(d, ":")
+		switch {
+		case qualifier == "any":
+			if p, ok := provider[name]; ok {
+				return p, true
+			}
+			for _, a := range foreign {
+				if p, ok := provider[name+":"+a]; ok {
+					return p, true
+				}
+			}
+			return "", false
+		case qualifier == "native" || qualifier == native:
+			p, ok := provider[name]
+			return p, ok
+		case qualifier != "":
+			p, ok := provider[d]
+			return p, ok
+		case arch != "":
+			// Prefer the package from the same foreign architecture, fall back to the native one such as the Multi-Arch: foreign tools.
+			if p, ok := provider[name+":"+arch]; ok {
+				return p, true
+			}
+		}
+		p, ok := provider[name]
+		return p, ok
+	}
+
+	// resolveAlternatives finds the provider of the first installed alternative in a dependency such as "mawk | awk".
+	resolveAlternatives := func(depalternatives, arch string) (string, bool) {
+		for _, d := range strings.Split(depalternatives, "|") {
+			d = strings.TrimSpace(d)
+			if d == "" {
+				continue
+			}
+			// Cut the version stuff.
+			d, _, _ = strings.Cut(d, "(")
+			if p, ok := resolve(strings.TrimSpace(d), arch); ok {
+				return p, true
+			}
+		}
+		return "", false
+	}
+
+	// Now resolve the dependencies using the provider map.
+	deps := make([]string, 0, 32)
+	for i := range pkgs {
+		deps := deps
+		for _, depalternatives := range strings.Split(depends[i], ",") {
+			if strings.TrimSpace(depalternatives) == "" {
+				continue
+			}
+			depprovider, ok := resolveAlternatives(depalternatives, arches[i])
+			if !ok {
+				return nil, fmt.Errorf("resolve %s: no provider found for dependency %s", pkgs[i].Name, depalternatives)
+			}
+			deps = append(deps, depprovider)
+		}
+		slices.Sort(deps)
+		pkgs[i].Deps = slices.Clone(slices.Compact(deps))
+
+		// Optional dependencies are recorded only if they are installed.
+		optdeps := deps[:0]
+		for _, depalternatives := range strings.Split(recommends[i], ",") {
+			if p, ok := resolveAlternatives(depalternatives, arches[i]); ok && p != pkgs[i].Name && !slices.Contains(pkgs[i].Deps, p) {
+				optdeps = append(optdeps, p)
+			}
+		}
+		slices.Sort(optdeps)
+		pkgs[i].OptDeps = slices.Clone(slices.Compact(optdeps))
+	}
+	return pkgs, nil
+}
+
+func (s opkg) Packages() ([]Package, error) {
+	statusfile, err := fs.ReadFile(s.rootfs, "usr/lib/opkg/status")
+	if err != nil {
+		return nil, err
+	}
+	stanzas := parseControl(statusfile)
+
+	// The status file only has the state of the packages, the rest of the fields are in the control files.
+	// Auto-Installed is only present for the automatically installed packages.
+	for _, stanza := range stanzas {
+		stanza["Auto-Installed"] = cmp.Or(stanza["Auto-Installed"], "no")
+		control, err := fs.ReadFile(s.rootfs, "usr/lib/opkg/info/"+stanza["Package"]+".control")
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range parseControl(control) {
+			for key, value := range c {
+				if _, exists := stanza[key]; !exists {
+					stanza[key] = value
+				}
+			}
+		}
+	}
+	return controlPackages(stanzas, 1)
+}
+
+func (s alpine) Packages() ([]Package, error) {
+	installed, err := fs.ReadFile(s.rootfs, "lib/apk/db/installed")
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		curpkg     Package // the current package that is being parsed
+		curdepends string  // the current package's dependency section
+
+		pkgs     = make([]Package, 0, 1e4)      // the return value
+		depends  = make([]string, 0, 1e4)       // the depends section for each package
+		provider = make(map[string]string, 1e4) // for tracking virtual packages, sonames and commands
+		provides = make([]string, 0, 64)        // the current package's provides section
+	)
+
+	for _, line := range strings.Split(string(installed)+"\n", "\n") {
+		if line == "" {
+			if curpkg.Name != "" {
+				pkgs, depends = append(pkgs, curpkg), append(depends, curdepends)
+				provider[curpkg.Name] = curpkg.Name
+				for _, p := range provides {
+					provider[p] = curpkg.Name
+				}
+			}
+			curpkg, curdepends, provides = Package{}, "", provides[:0]
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("parse /lib/apk/db/installed: unexpected line %q", line)
+		}
+		switch key {
+		case "P":
+			curpkg.Name = value
+		case "T":
+			curpkg.Desc = value
+		case "I":
+			curpkg.Size, _ = strconv.ParseInt(value, 10, 64)
+		case "D":
+			curdepends = value
+		case "p":
+			for _, p := range strings.Fields(value) {
+				// Remove the version bit from instances like "so:libc.musl-x86_64.so.1=1" and "cmd:ls=9.4-r1".
+				p, _, _ = strings.Cut(p, "=")
+				provides = append(provides, p)
+			}
+		}
+	}
+
+	// Now resolve the dependencies using the provider map.
+	deps := make([]string, 0, 32)
+	for i := range pkgs {
+		deps := deps
+		for _, d := range strings.Fields(depends[i]) {
+			if strings.HasPrefix(d, "!") {
+				// A conflict, not a dependency.
+				continue
+			}
+			// Remove the version and the repository pinning bit from instances like "musl>=1.2" and "foo@edge".
+			d, _, _ = strings.Cut(d, "@")
+			if pos := strings.IndexAny(d, "<>=~"); pos != -1 {
+				d = d[:pos]
+			}
+			p, ok := provider[d]
+			if !ok {
+				return nil, fmt.Errorf("resolve %s: no provider found for dependency %s", pkgs[i].Name, d)
+			}
+			deps = append(deps, p)
+		}
+		slices.Sort(deps)
+		pkgs[i].Deps = slices.Clone(slices.Compact(deps))
+	}
+	return pkgs, nil
+}
+
+func (s rpm) Packages() ([]Package, error) {
+	manifest, err := fs.ReadFile(s.rootfs, rpmManifest)
+	if errors.Is(err, fs.ErrNotExist) && s.rootfs == os.DirFS("/") {
+		// rpm can only query the database of the real system, not the one of a mocked filesystem.
+		if manifest, err = exec.Command("rpm", "-qa", "--queryformat", rpmQueryformat).Output(); err != nil {
+			return nil, fmt.Errorf("run rpm -qa: %v", err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("read /%s: %v", rpmManifest, err)
+	}
+
+	var (
+		curpkg      Package  // the current package that is being parsed
+		curarch     string   // the current package's architecture
+		currequires []string // the current package's requires
+		curprovides []string // the current package's provides and files
+
+		pkgs     = make([]Package, 0, 1e4)     // the return value
+		arches   = make([]string, 0, 1e4)      // the architecture of each package
+		requires = make([][]string, 0, 1e4)    // the requires section for each package
+		provides = make([][]string, 0, 1e4)    // the provides and files for each package
+		names    = make(map[string]int, 1e4)   // the number of packages with a given name
+		provider = make(map[string][]int, 1e4) // for tracking virtual packages and files, multilib packages provide the same names
+		native   = map[string]int{}            // the number of packages per architecture to find the native one
+	)
+
+	for _, line := range strings.Split(string(manifest)+"\n", "\n") {
+		if line == "" {
+			// The gpg-pubkey entries are not real packages, skip them.
+			if curpkg.Name != "" && curpkg.Name != "gpg-pubkey" {
+				pkgs, arches = append(pkgs, curpkg), append(arches, curarch)
+				requires, provides = append(requires, currequires), append(provides, curprovides)
+				names[curpkg.Name]++
+				native[curarch]++
+			}
+			curpkg, curarch, currequires, curprovides = Package{}, "", nil, nil
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("parse rpm manifest: unexpected line %q", line)
+		}
+		value = strings.TrimSpace(value)
+		switch key {
+		case "Name":
+			curpkg.Name = value
+		case "Arch":
+			curarch = value
+		case "Summary":
+			curpkg.Desc = value
+		case "Size":
+			curpkg.Size, _ = strconv.ParseInt(value, 10, 64)
+		case "Requires":
+			currequires = append(currequires, value)
+		case "Provides", "File":
+			curprovides = append(curprovides, value)
+		}
+	}
+
+	// Multilib packages such as glibc.i686 and glibc.x86_64 share the name so qualify them with their architecture.
+	for i := range pkgs {
+		if names[pkgs[i].Name] > 1 {
+			pkgs[i].Name += "." + arches[i]
+		}
+		provider[pkgs[i].Name] = append(provider[pkgs[i].Name], i)
+		for _, p := range provides[i] {
+			provider[p] = append(provider[p], i)
+		}
+	}
+
+	// The native architecture is the most common one, the noarch packages depend on its multilib packages.
+	delete(native, "noarch")
+	nativearch := ""
+	for _, arch := range slices.Sorted(maps.Keys(native)) {
+		if nativearch == "" || native[arch] > native[nativearch] {
+			nativearch = arch
+		}
+	}
+
+	// Now resolve the dependencies using the provider map.
+	// If multiple packages provide a dependency, e.g. both glibc.i686 and glibc.x86_64 provide glibc, then prefer the one with the same architecture.
+	resolve := func(i int, dep string) (string, bool) {
+		candidates := provider[dep]
+		if len(candidates) == 0 {
+			return "", false
+		}
+		arch := arches[i]
+		if arch == "noarch" {
+			arch = nativearch
+		}
+		for _, c := range candidates {
+			if arches[c] == arch {
+				return pkgs[c].Name, true
+			}
+		}
+		return pkgs[candidates[0]].Name, true
+	}
+	deps := make([]string, 0, 32)
+	for i := range pkgs {
+		deps := deps
+		for _, d := range requires[i] {
+			if strings.HasPrefix(d, "rpmlib(") {
+				// Features of rpm itself, not provided by any package.
+				continue
+			}
+			if strings.HasPrefix(d, "(") {
+				// A rich dependency such as "(glibc-gconv-extra(x86-64) = 2.39 if redhat-rpm-config)".
+				// Keep all the installed packages it mentions, that's the safe choice for trimming.
+				for _, term := range strings.Fields(d) {
+					// Strip the grouping parentheses but keep the ones in names like "libc.so.6()(64bit)".
+					term = strings.TrimLeft(term, "(")
+					for strings.Count(term, ")") > strings.Count(term, "(") {
+						term = term[:len(term)-1]
+					}
+					if p, ok := resolve(i, term); ok && p != pkgs[i].Name {
+						deps = append(deps, p)
+					}
+				}
+				continue
+			}
+			p, ok := resolve(i, d)
+			if !ok {
+				return nil, fmt.Errorf("resolve %s: no provider found for dependency %s", pkgs[i].Name, d)
+			}
+			if p != pkgs[i].Name {
+				// Packages often require their own sonames, skip these.
+				deps = append(deps, p)
+			}
+		}
+		slices.Sort(deps)
+		pkgs[i].Deps = slices.Clone(slices.Compact(deps))
+	}
+	return pkgs, nil
+}
+
+// gentooVersionRE matches the version suffix of a package name such as "-1.2.3_rc1-r2".
+var gentooVersionRE = regexp.MustCompile(`-[0-9]+(\.[0-9]+)*[a-z]?((_alpha|_beta|_pre|_rc|_p)[0-9]*)*(-r[0-9]+)?\*?$`)
+
+// gentooAtom is a single package dependency such as ">=dev-libs/openssl-3.0:0/3=[abi_x86_64(-)]".
+type gentooAtom struct {
+	name    string // category and package name such as "dev-libs/openssl"
+	slot    string // the slot without the subslot or empty if unspecified
+	blocker bool   // whether this is a blocker atom such as "!<sys-apps/foo-1.0"
+}
+
+// parseGentooAtom parses an atom from a dependency specification.
+func parseGentooAtom(s string) (gentooAtom, error) {
+	var atom gentooAtom
+	orig := s
+	if strings.HasPrefix(s, "!") {
+		atom.blocker, s = true, strings.TrimLeft(s, "!")
+	}
+	s, _, _ = strings.Cut(s, "[")  // use dependencies
+	s, _, _ = strings.Cut(s, "::") // repository
+	s, atom.slot, _ = strings.Cut(s, ":")
+	atom.slot, _, _ = strings.Cut(strings.TrimRight(atom.slot, "=*"), "/")
+	if trimmed := strings.TrimLeft(s, "<>=~"); trimmed != s {
+		// Only atoms with an operator have a version.
+		loc := gentooVersionRE.FindStringIndex(trimmed)
+		if loc == nil {
+			return atom, fmt.Errorf("parse atom %q: no version found", orig)
+		}
+		s = trimmed[:loc[0]]
+	}
+	if strings.Count(s, "/") != 1 || strings.HasPrefix(s, "/") || strings.HasSuffix(s, "/") {
+		return atom, fmt.Errorf("parse atom %q: want category/package", orig)
+	}
+	atom.name = s
+	return atom, nil
+}
+
+// gentooDep is a node in a parsed dependency specification such as RDEPEND.
+// The leaf nodes are atoms, the inner nodes are groups that need all (or any for || groups) of their children.
+type gentooDep struct {
+	atom  gentooAtom  // the atom for leaf nodes
+	group bool        // whether this is a group
+	anyOf bool        // whether this is a || group
+	deps  []gentooDep // the children of a group
+}
+
+// parseGentooDepend parses a dependency specification such as "a/b || ( c/d:1 e/f ) use? ( g/h )" into an all-of group.
+// USE conditionals are already evaluated for installed packages so they are treated as simple groups.
+func parseGentooDepend(spec string) (gentooDep, error) {
+	tokens := strings.Fields(spec)
+	var parse func(anyOf, nested bool) (gentooDep, error)
+	parse = func(anyOf, nested bool) (gentooDep, error) {
+		group := gentooDep{group: true, anyOf: anyOf}
+		for len(tokens) > 0 {
+			token := tokens[0]
+			tokens = tokens[1:]
+			switch {
+			case token == ")":
+				if !nested {
+					return group, fmt.Errorf("parse %q: unbalanced )", spec)
+				}
+				return group, nil
+			case token == "||" || strings.HasSuffix(token, "?") || token == "(":
+				if token != "(" {
+					if len(tokens) == 0 || tokens[0] != "(" {
+						return group, fmt.Errorf("parse %q: missing ( after %s", spec, token)
+					}
+					tokens = tokens[1:]
+				}
+				subgroup, err := parse(token == "||", true)
+				if err != nil {
+					return group, err
+				}
+				group.deps = append(group.deps, subgroup)
+			default:
+				atom, err := parseGentooAtom(token)
+				if err != nil {
+					return group, fmt.Errorf("parse %q: %v", spec, err)
+				}
+				group.deps = append(group.deps, gentooDep{atom: atom})
+			}
+		}
+		if nested {
+			return group, fmt.Errorf("parse %q: missing )", spec)
+		}
+		return group, nil
+	}
+	return parse(false, false)
+}
+
+// String formats the dependency back into a normalized specification.
+func (d gentooDep) String() string {
+	if !d.group {
+		s := d.atom.name
+		if d.atom.slot != "" {
+			s += ":" + d.atom.slot
+		}
+		if d.atom.blocker {
+			s = "!" + s
+		}
+		return s
+	}
+	parts := make([]string, 0, len(d.deps)+3)
+	if d.anyOf {
+		parts = append(parts, "||")
+	}
+	parts = append(parts, "(")
+	for _, dep := range d.deps {
+		parts = append(parts, dep.String())
+	}
+	return strings.Join(append(parts, ")"), " ")
+}
+
+func (s gentoo) Packages() ([]Package, error) {
+	pkgdirs, err := fs.Glob(s.rootfs, "var/db/pkg/*/*")
+	if err != nil {
+		return nil, fmt.Errorf("glob /var/db/pkg/*/*: %v", err)
+	}
+	if len(pkgdirs) == 0 {
+		return nil, fmt.Errorf("glob /var/db/pkg/*/*: no results")
+	}
+
+	var (
+		pkgs      = make([]Package, 0, 1e4)        // the return value
+		pkgslots  = make([]string, 0, 1e4)         // the slot of each package
+		rdepends  = make([]gentooDep, 0, 1e4)      // the parsed RDEPEND for each package
+		provides  = make([][]string, 0, 1e4)       // the provided sonames for each package
+		requires  = make([][]string, 0, 1e4)       // the required sonames for each package
+		slotcount = make(map[string]int, 1e4)      // the number of installed slots for each category/package
+		installed = make(map[string][]string, 1e4) // the package names of each installed category/package
+		slotof    = make(map[string]string, 1e4)   // the slot of each package name
+		provider  = make(map[string]string, 1e4)   // for tracking sonames
+	)
+
+	// readfield reads a single value file from the package's directory.
+	readfield := func(dir, field string) (string, error) {
+		data, err := fs.ReadFile(s.rootfs, path.Join(dir, field))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+
+	for _, dir := range pkgdirs {
+		if strings.HasPrefix(path.Base(dir), "-MERGING-") {
+			continue
+		}
+		loc := gentooVersionRE.FindStringIndex(path.Base(dir))
+		if loc == nil {
+			return nil, fmt.Errorf("parse /%s: no version in the directory name", dir)
+		}
+		var (
+			pkg                             = Package{Name: strings.TrimPrefix(path.Dir(dir), "var/db/pkg/") + "/" + path.Base(dir)[:loc[0]]}
+			size, slot, rdepend, prov, reqs string
+		)
+		for _, field := range []struct {
+			name  string
+			value *string
+		}{{"DESCRIPTION", &pkg.Desc}, {"SIZE", &size}, {"SLOT", &slot}, {"RDEPEND", &rdepend}, {"PROVIDES", &prov}, {"REQUIRES", &reqs}} {
+			if *field.value, err = readfield(dir, field.name); err != nil {
+				return nil, fmt.Errorf("read %s: %v", field.name, err)
+			}
+		}
+		pkg.Size, _ = strconv.ParseInt(size, 10, 64)
+		slot, _, _ = strings.Cut(slot, "/") // remove the subslot
+		dep, err := parseGentooDepend(rdepend)
+		if err != nil {
+			return nil, fmt.Errorf("parse /%s/RDEPEND: %v", dir, err)
+		}
+		pkgs, pkgslots, rdepends = append(pkgs, pkg), append(pkgslots, slot), append(rdepends, dep)
+		provides, requires = append(provides, gentooSonames(prov)), append(requires, gentooSonames(reqs))
+		slotcount[pkg.Name]++
+	}
+
+	// Qualify the names of the packages that have multiple slots installed such as "dev-lang/python:3.12".
+	for i := range pkgs {
+		atom := pkgs[i].Name
+		if slotcount[atom] > 1 {
+			pkgs[i].Name += ":" + pkgslots[i]
+		}
+		installed[atom] = append(installed[atom], pkgs[i].Name)
+		slotof[pkgs[i].Name] = pkgslots[i]
+		for _, soname := range provides[i] {
+			provider[soname] = pkgs[i].Name
+		}
+	}
+
+	// resolve returns the installed packages satisfying dep or false if it cannot be satisfied.
+	var resolve func(dep gentooDep) ([]string, bool)
+	resolve = func(dep gentooDep) ([]string, bool) {
+		if !dep.group {
+			if dep.atom.blocker {
+				return nil, true
+			}
+			// Depend on all the installed slots if the atom doesn't select one, that's the safe choice for trimming.
+			names := installed[dep.atom.name]
+			if dep.atom.slot != "" {
+				names = slices.DeleteFunc(slices.Clone(names), func(name string) bool { return slotof[name] != dep.atom.slot })
+			}
+			return names, len(names) > 0
+		}
+		var result []string
+		for _, d := range dep.deps {
+			r, ok := resolve(d)
+			if dep.anyOf && ok {
+				return r, true
+			}
+			if !dep.anyOf && !ok {
+				return nil, false
+			}
+			result = append(result, r...)
+		}
+		return result, !dep.anyOf || len(dep.deps) == 0
+	}
+
+	// Now resolve the dependencies.
+	for i := range pkgs {
+		var deps []string
+		for _, d := range rdepends[i].deps {
+			r, ok := resolve(d)
+			if !ok {
+				return nil, fmt.Errorf("resolve %s: no installed package satisfies %s", pkgs[i].Name, d)
+			}
+			deps = append(deps, r...)
+		}
+		for _, soname := range requires[i] {
+			// The sonames come from the installed files so a missing provider is not fatal.
+			// It's most likely a library from outside the package manager.
+			if p, ok := provider[soname]; ok {
+				deps = append(deps, p)
+			}
+		}
+		deps = slices.DeleteFunc(deps, func(d string) bool { return d == pkgs[i].Name })
+		slices.Sort(deps)
+		pkgs[i].Deps = slices.Compact(deps)
+	}
+	return pkgs, nil
+}
+
+// gentooSonames parses a PROVIDES or REQUIRES entry such as "x86_64: libc.so.6 libm.so.6 x86_32: libc.so.6".
+// The sonames are qualified with their architecture so they look like "x86_64:libc.so.6".
+func gentooSonames(s string) []string {
+	var arch string
+	var sonames []string
+	for _, field := range strings.Fields(s) {
+		if strings.HasSuffix(field, ":") {
+			arch = field
+			continue
+		}
+		sonames = append(sonames, arch+field)
+	}
+	return sonames
+}
+
+// decodePlist decodes an XML property list.
+// The values are map[string]any for dicts, []any for arrays, string, int64, float64, bool and []byte.
+// Dates are left as strings.
+func decodePlist(r io.Reader) (any, error) {
+	d := xml.NewDecoder(r)
+
+	// next returns the next start or end element.
+	next := func() (xml.Token, error) {
+		for {
+			tok, err := d.Token()
+			if err != nil {
+				return nil, err
+			}
+			switch tok := tok.(type) {
+			case xml.StartElement, xml.EndElement:
+				return xml.CopyToken(tok), nil
+			case xml.CharData:
+				if len(bytes.TrimSpace(tok)) > 0 {
+					return nil, fmt.Errorf("unexpected text %q", bytes.TrimSpace(tok))
+				}
+			}
+		}
+	}
+
+	// decode decodes the value starting with the start element.
+	var decode func(start xml.StartElement) (any, error)
+	decode = func(start xml.StartElement) (any, error) {
+		switch start.Name.Local {
+		case "dict":
+			dict := map[string]any{}
+			for {
+				tok, err := next()
+				if err != nil {
+					return nil, err
+				}
+				if _, ok := tok.(xml.EndElement); ok {
+					return dict, nil
+				}
+				keyelem := tok.(xml.StartElement)
+				if keyelem.Name.Local != "key" {
+					return nil, fmt.Errorf("got <%s> in dict, want <key>", keyelem.Name.Local)
+				}
+				var key string
+				if err := d.DecodeElement(&key, &keyelem); err != nil {
+					return nil, fmt.Errorf("decode key: %v", err)
+				}
+				tok, err = next()
+				if err != nil {
+					return nil, err
+				}
+				valueelem, ok := tok.(xml.StartElement)
+				if !ok {
+					return nil, fmt.Errorf("missing value for key %q", key)
+				}
+				if dict[key], err = decode(valueelem); err != nil {
+					return nil, fmt.Errorf("decode %q: %v", key, err)
+				}
+			}
+		case "array":
+			array := []any{}
+			for {
+				tok, err := next()
+				if err != nil {
+					return nil, err
+				}
+				if _, ok := tok.(xml.EndElement); ok {
+					return array, nil
+				}
+				v, err := decode(tok.(xml.StartElement))
+				if err != nil {
+					return nil, fmt.Errorf("decode array element %d: %v", len(array), err)
+				}
+				array = append(array, v)
+			}
+		case "true", "false":
+			return start.Name.Local == "true", d.Skip()
+		}
+
+		var text string
+		if err := d.DecodeElement(&text, &start); err != nil {
+			return nil, err
+		}
+		text = strings.TrimSpace(text)
+		switch start.Name.Local {
+		case "string", "date":
+			return text, nil
+		case "integer":
+			return strconv.ParseInt(text, 10, 64)
+		case "real":
+			return strconv.ParseFloat(text, 64)
+		case "data":
+			return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(text), ""))
+		}
+		return nil, fmt.Errorf("unknown element <%s>", start.Name.Local)
+	}
+
+	tok, err := next()
+	if err != nil {
+		return nil, err
+	}
+	if start, ok := tok.(xml.StartElement); !ok || start.Name.Local != "plist" {
+		return nil, fmt.Errorf("missing <plist> root element")
+	}
+	tok, err = next()
+	if err != nil {
+		return nil, err
+	}
+	start, ok := tok.(xml.StartElement)
+	if !ok {
+		return nil, fmt.Errorf("empty <plist>")
+	}
+	return decode(start)
+}
+
+// voidVersionRE matches the version suffix of an xbps package pattern such as "-2.39_1" or "-6.6.*".
+var voidVersionRE = regexp.MustCompile(`-[^-]*(_[0-9]+|[*?[][^-]*)$`)
+
+// voidPkgname returns the package name from an xbps package pattern such as "glibc>=2.32_1", "awk-0_1" or "linux6.6-6.6.*".
+func voidPkgname(pattern string) string {
+	if i := strings.IndexAny(pattern, "<>"); i != -1 {
+		return pattern[:i]
+	}
+	if loc := voidVersionRE.FindStringIndex(pattern); loc != nil {
+		return pattern[:loc[0]]
+	}
+	return pattern
+}
+
+func (s void) Packages() ([]Package, error) {
+	data, err := fs.ReadFile(s.rootfs, s.pkgdb)
+	if err != nil {
+		return nil, err
+	}
+	plist, err := decodePlist(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("decode /%s: %v", s.pkgdb, err)
+	}
+	pkgdb, ok := plist.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("decode /%s: root is %T, want dict", s.pkgdb, plist)
+	}
+
+	var (
+		pkgs     = make([]Package, 0, 1e4)      // the return value
+		depends  = make([][]any, 0, 1e4)        // the run_depends section for each package
+		provider = make(map[string]string, 1e4) // for tracking virtual packages
+	)
+
+	for _, name := range slices.Sorted(maps.Keys(pkgdb)) {
+		if strings.HasPrefix(name, "_XBPS_") {
+			// Metadata such as _XBPS_ALTERNATIVES_.
+			continue
+		}
+		entry, ok := pkgdb[name].(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("decode /%s: entry %s is %T, want dict", s.pkgdb, name, pkgdb[name])
+		}
+		if state, _ := entry["state"].(string); state != "installed" {
+			continue
+		}
+		pkg := Package{Name: name}
+		pkg.Desc, _ = entry["short_desc"].(string)
+		pkg.Size, _ = entry["installed_size"].(int64)
+		if pkgver, _ := entry["pkgver"].(string); pkgver != "" && voidPkgname(pkgver) != name {
+			return nil, fmt.Errorf("decode /%s: entry %s has pkgver %s", s.pkgdb, name, pkgver)
+		}
+		provides, _ := entry["provides"].([]any)
+		for _, p := range provides {
+			if p, ok := p.(string); ok {
+				provider[voidPkgname(p)] = name
+			}
+		}
+		provider[name] = name
+		rundeps, _ := entry["run_depends"].([]any)
+		pkgs, depends = append(pkgs, pkg), append(depends, rundeps)
+	}
+
+	// Now resolve the dependencies using the provider map.
+	deps := make([]string, 0, 32)
+	for i := range pkgs {
+		deps := deps
+		for _, d := range depends[i] {
+			pattern, _ := d.(string)
+			p, ok := provider[voidPkgname(pattern)]
+			if !ok {
+				return nil, fmt.Errorf("resolve %s: no provider found for dependency %s", pkgs[i].Name, pattern)
+			}
+			deps = append(deps, p)
+		}
+		slices.Sort(deps)
+		pkgs[i].Deps = slices.Clone(slices.Compact(deps))
+	}
+	return pkgs, nil
+}
+
+// parseINI parses an INI style file such as Flatpak's metadata into sections of keys and values.
+func parseINI(data []byte) map[string]map[string]string {
+	sections := map[string]map[string]string{}
+	section := map[string]string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = map[string]string{}
+			sections[line[1:len(line)-1]] = section
+			continue
+		}
+		key, value, _ := strings.Cut(line, "=")
+		section[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return sections
+}
+
+// dirsize returns the total size of the regular files in a directory tree.
+func dirsize(rootfs fs.FS, dir string) (int64, error) {
+	var size int64
+	err := fs.WalkDir(rootfs, dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
+func (s flatpak) Packages() ([]Package, error) {
+	metadatas, err := fs.Glob(s.rootfs, "var/lib/flatpak/*/*/*/*/active/metadata")
+	if err != nil {
+		return nil, fmt.Errorf("glob /var/lib/flatpak/*/*/*/*/active/metadata: %v", err)
+	}
+
+	var (
+		pkgs      = make([]Package, 0, len(metadatas))  // the return value
+		refs      = make([]string, 0, len(metadatas))   // the ref of each package such as app/org.gimp.GIMP/x86_64/stable
+		depends   = make([][]string, 0, len(metadatas)) // the refs each package depends on
+		appcount  = make(map[string]int, len(metadatas))
+		refnames  = make(map[string]string, len(metadatas)) // maps refs to package names
+		extension = make(map[string][]string)               // maps refs to the refs of their installed extensions
+	)
+	for _, metadata := range metadatas {
+		// The path looks like var/lib/flatpak/app/org.gimp.GIMP/x86_64/stable/active/metadata.
+		parts := strings.Split(metadata, "/")
+		kind, id, arch, branch := parts[3], parts[4], parts[5], parts[6]
+		if kind != "app" && kind != "runtime" {
+			continue
+		}
+		ref := strings.Join([]string{kind, id, arch, branch}, "/")
+		data, err := fs.ReadFile(s.rootfs, metadata)
+		if err != nil {
+			return nil, err
+		}
+		ini := parseINI(data)
+		size, err := dirsize(s.rootfs, path.Dir(metadata))
+		if err != nil {
+			return nil, fmt.Errorf("compute the size of %s: %v", ref, err)
+		}
+
+		var deps []string
+		for _, section := range []string{"Application", "Runtime"} {
+			if runtime := ini[section]["runtime"]; runtime != "" && "runtime/"+runtime != ref {
+				deps = append(deps, "runtime/"+runtime)
+			}
+		}
+		if extended := ini["ExtensionOf"]["ref"]; extended != "" {
+			// Removing the extended app or runtime removes the extension too so it behaves like a dependency of the extended ref.
+			extension[extended] = append(extension[extended], ref)
+		}
+		if kind == "app" {
+			appcount[id]++
+		}
+		pkgs = append(pkgs, Package{Name: id, Desc: ref, Size: size})
+		refs, depends = append(refs, ref), append(depends, deps)
+	}
+
+	// Name the packages like flatpak's command line interface expects them.
+	// Runtimes often have multiple branches installed so their names always contain the branch.
+	for i := range pkgs {
+		kind, _, _ := strings.Cut(refs[i], "/")
+		branch := refs[i][strings.LastIndexByte(refs[i], '/')+1:]
+		if kind == "runtime" || appcount[pkgs[i].Name] > 1 {
+			pkgs[i].Name += "//" + branch
+		}
+		pkgs[i].Name = flatpakPrefix + pkgs[i].Name
+		refnames[refs[i]] = pkgs[i].Name
+	}
+
+	for i := range pkgs {
+		var deps []string
+		for _, ref := range append(depends[i], extension[refs[i]]...) {
+			name, ok := refnames[ref]
+			if !ok {
+				return nil, fmt.Errorf("resolve %s: %s is not installed", pkgs[i].Name, ref)
+			}
+			deps = append(deps, name)
+		}
+		slices.Sort(deps)
+		pkgs[i].Deps = slices.Compact(deps)
+	}
+	return pkgs, nil
+}
+
+func (s snap) Packages() ([]Package, error) {
+	data, err := fs.ReadFile(s.rootfs, "var/lib/snapd/state.json")
+	if err != nil {
+		return nil, err
+	}
+	var state struct {
+		Data struct {
+			Snaps map[string]struct {
+				Type     string `json:"type"`
+				Current  string `json:"current"`
+				Sequence []struct {
+					Revision string `json:"revision"`
+					Summary  string `json:"summary"`
+				} `json:"sequence"`
+			} `json:"snaps"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("parse /var/lib/snapd/state.json: %v", err)
+	}
+
+	pkgs := make([]Package, 0, len(state.Data.Snaps))
+	for _, name := range slices.Sorted(maps.Keys(state.Data.Snaps)) {
+		info := state.Data.Snaps[name]
+		pkg := Package{Name: snapPrefix + name}
+		// The disabled older revisions also take space so count them too.
+		for _, rev := range info.Sequence {
+			if rev.Revision == info.Current {
+				pkg.Desc = rev.Summary
+			}
+			if fi, err := fs.Stat(s.rootfs, fmt.Sprintf("var/lib/snapd/snaps/%s_%s.snap", name, rev.Revision)); err == nil {
+				pkg.Size += fi.Size()
+			}
+		}
+
+		// The dependencies are in the snap's own metadata: the base snap and the default providers of the content plugs.
+		// The base defaults to core for apps.
+		var base string
+		if info.Type == "app" {
+			base = "core"
+		}
+		snapyaml, err := fs.ReadFile(s.rootfs, fmt.Sprintf("snap/%s/%s/meta/snap.yaml", name, info.Current))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		var deps []string
+		for _, line := range strings.Split(string(snapyaml), "\n") {
+			key, value, _ := strings.Cut(strings.TrimSpace(line), ":")
+			value = strings.Trim(strings.TrimSpace(value), `"'`)
+			switch {
+			case key == "base" && !strings.HasPrefix(line, " "):
+				base = value
+			case key == "default-provider":
+				// Older snaps use the provider:slot form.
+				// snapd only suggests installing the default providers so skip the missing ones.
+				provider, _, _ := strings.Cut(value, ":")
+				if _, ok := state.Data.Snaps[provider]; ok {
+					deps = append(deps, provider)
+				}
+			}
+		}
+		if base != "" && base != "none" {
+			if _, ok := state.Data.Snaps[base]; !ok {
+				return nil, fmt.Errorf("resolve %s: base snap %s is not installed", pkg.Name, base)
+			}
+			deps = append(deps, base)
+		}
+		for i, d := range deps {
+			deps[i] = snapPrefix + d
+		}
+		slices.Sort(deps)
+		pkg.Deps = slices.Compact(deps)
+		pkgs = append(pkgs, pkg)
 	}
 	return pkgs, nil
 }
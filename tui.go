@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// tuiEntry is a row of -tui: an unintentional top level package and what the user decided about it.
+type tuiEntry struct {
+	TopLevelEntry
+	uniqueDeps []string // the packages only this package keeps installed
+	expanded   bool     // show uniqueDeps under the row
+	remove     bool     // marked for removal
+	keep       bool     // marked for appending to .pkgtrim
+	comment    string   // the .pkgtrim comment for the kept packages
+}
+
+// The screens of -tui.
+const (
+	tuiList    = iota // the list of the packages
+	tuiComment        // typing the comment of a package to keep
+	tuiConfirm        // the summary of the changes waiting for a confirmation
+	tuiDone           // the user quit
+)
+
+// tuiModel is the state of -tui.
+// It doesn't do any I/O so it's testable, runTUI connects it to the terminal.
+type tuiModel struct {
+	entries   []tuiEntry
+	trimfile  string
+	units     string                           // the unit of the sizes, see formatSize
+	plan      func(remove []string) [][]string // returns the commands that remove the given packages and their unique dependencies
+	screen    int
+	cursor    int    // the selected entry
+	offset    int    // the first visible line of the list
+	input     string // the comment being typed
+	confirmed bool   // the user confirmed the changes
+}
+
+// marked returns the packages marked for removal and the lines to append to .pkgtrim.
+func (m *tuiModel) marked() (remove []string, keep []string) {
+	for _, e := range m.entries {
+		if e.remove {
+			remove = append(remove, e.Packages...)
+		}
+		if e.keep {
+			line := strings.Join(e.Packages, " ")
+			if e.comment != "" {
+				line += "  # " + e.comment
+			}
+			keep = append(keep, line)
+		}
+	}
+	return remove, keep
+}
+
+// update handles a key from parseKeys.
+func (m *tuiModel) update(key string) {
+	switch m.screen {
+	case tuiList:
+		if len(m.entries) == 0 {
+			if key == "q" || key == "ctrl-c" || key == "esc" {
+				m.screen = tuiDone
+			}
+			return
+		}
+		e := &m.entries[m.cursor]
+		switch key {
+		case "up", "k":
+			m.cursor = max(m.cursor-1, 0)
+		case "down", "j":
+			m.cursor = min(m.cursor+1, len(m.entries)-1)
+		case "enter", " ", "left", "right":
+			e.expanded = !e.expanded
+		case "r":
+			e.remove, e.keep = !e.remove, false
+		case "i":
+			if e.keep {
+				e.keep = false
+			} else {
+				m.screen, m.input = tuiComment, e.comment
+			}
+		case "q":
+			if remove, keep := m.marked(); len(remove)+len(keep) > 0 {
+				m.screen = tuiConfirm
+			} else {
+				m.screen = tuiDone
+			}
+		case "ctrl-c":
+			m.screen = tuiDone
+		}
+	case tuiComment:
+		switch key {
+		case "enter":
+			e := &m.entries[m.cursor]
+			e.keep, e.remove, e.comment = true, false, strings.TrimSpace(m.input)
+			m.screen = tuiList
+		case "esc", "ctrl-c":
+			m.screen = tuiList
+		case "backspace":
+			_, size := utf8.DecodeLastRuneInString(m.input)
+			m.input = m.input[:len(m.input)-size]
+		default:
+			if utf8.RuneCountInString(key) == 1 {
+				m.input += key
+			}
+		}
+	case tuiConfirm:
+		switch key {
+		case "y":
+			m.screen, m.confirmed = tuiDone, true
+		case "n", "q", "esc":
+			m.screen = tuiList
+		case "ctrl-c":
+			m.screen = tuiDone
+		}
+	}
+}
+
+// view returns the lines of the screen for a terminal with the given size.
+func (m *tuiModel) view(rows, cols int) []string {
+	clip := func(line string) string {
+		if utf8.RuneCountInString(line) > cols {
+			return string([]rune(line)[:cols])
+		}
+		return line
+	}
+	if m.screen == tuiConfirm {
+		remove, keep := m.marked()
+		lines := make([]string, 0, 16)
+		if len(remove) > 0 {
+			lines = append(lines, "Commands to run:")
+			for _, argv := range m.plan(remove) {
+				lines = append(lines, "  "+strings.Join(argv, " "))
+			}
+		}
+		if len(keep) > 0 {
+			lines = append(lines, fmt.Sprintf("Lines to append to %s:", m.trimfile))
+			for _, line := range keep {
+				lines = append(lines, "  "+line)
+			}
+		}
+		lines = append(lines, "", "Press y to confirm, n to go back.")
+		for i := range lines {
+			lines[i] = clip(lines[i])
+		}
+		return lines
+	}
+
+	header := "j/k: move, enter: expand, r: remove, i: add to " + m.trimfile + ", q: finish"
+	if len(m.entries) == 0 {
+		return []string{clip(header), "No unintentional packages found."}
+	}
+	body, cursorLine, cursorEnd := make([]string, 0, len(m.entries)), 0, 0
+	for i, e := range m.entries {
+		mark := "   "
+		if e.remove {
+			mark = "[R]"
+		} else if e.keep {
+			mark = "[K]"
+		}
+		selected := " "
+		if i == m.cursor {
+			selected, cursorLine = ">", len(body)
+		}
+		body = append(body, clip(fmt.Sprintf("%s%s %s %-24s %s", selected, mark, formatSize(e.UniqueSize, m.units), strings.Join(e.Packages, ","), e.Desc)))
+		if e.expanded {
+			if len(e.uniqueDeps) == 0 {
+				body = append(body, clip("        no unique dependencies"))
+			}
+			for _, dep := range e.uniqueDeps {
+				body = append(body, clip("        "+dep))
+			}
+		}
+		if i == m.cursor {
+			cursorEnd = len(body) - 1
+		}
+	}
+
+	// Scroll so that the selected row and as much of its expansion as possible is visible below the header and above the status line.
+	height := max(rows-2, 1)
+	m.offset = min(m.offset, cursorLine)
+	if cursorEnd >= m.offset+height {
+		m.offset = min(cursorLine, cursorEnd-height+1)
+	}
+	lines := append([]string{clip(header)}, body[m.offset:min(m.offset+height, len(body))]...)
+	if m.screen == tuiComment {
+		lines = append(lines, clip(fmt.Sprintf("Comment for %s (enter to save, esc to cancel): %s", m.entries[m.cursor].Name, m.input)))
+	}
+	return lines
+}
+
+// parseKeys splits the bytes read from a raw terminal into keys.
+// The special keys have names such as "up" or "ctrl-c", the rest are the typed characters.
+func parseKeys(data []byte) []string {
+	keys := make([]string, 0, len(data))
+	names := []struct{ seq, name string }{
+		{"\x1b[A", "up"}, {"\x1b[B", "down"}, {"\x1b[C", "right"}, {"\x1b[D", "left"},
+		{"\x1bOA", "up"}, {"\x1bOB", "down"}, {"\x1bOC", "right"}, {"\x1bOD", "left"},
+		{"\r", "enter"}, {"\n", "enter"}, {"\x7f", "backspace"}, {"\x08", "backspace"}, {"\x03", "ctrl-c"},
+	}
+	s := string(data)
+	for len(s) > 0 {
+		i := slices.IndexFunc(names, func(n struct{ seq, name string }) bool { return strings.HasPrefix(s, n.seq) })
+		switch {
+		case i >= 0:
+			keys, s = append(keys, names[i].name), s[len(names[i].seq):]
+		case s[0] == '\x1b':
+			// An unknown escape sequence or a lone escape, skip the sequence.
+			keys, s = append(keys, "esc"), s[1:]
+			if strings.HasPrefix(s, "[") {
+				end := strings.IndexFunc(s[1:], func(r rune) bool { return r >= '@' && r <= '~' })
+				s = s[min(end+2, len(s)):]
+			}
+		default:
+			_, size := utf8.DecodeRuneInString(s)
+			keys, s = append(keys, s[:size]), s[size:]
+		}
+	}
+	return keys
+}
+
+// runTUI runs the model on the terminal until the user quits.
+func runTUI(in *os.File, w io.Writer, m *tuiModel) error {
+	fd := int(in.Fd())
+	restore, err := makeRaw(fd)
+	if err != nil {
+		return fmt.Errorf("-tui needs a terminal: %v", err)
+	}
+	defer restore()
+
+	// Use the alternate screen so the terminal's content is restored on exit.
+	fmt.Fprint(w, "\x1b[?1049h\x1b[?25l")
+	defer fmt.Fprint(w, "\x1b[?25h\x1b[?1049l")
+	buf := make([]byte, 256)
+	for m.screen != tuiDone {
+		rows, cols := termSize(fd)
+		fmt.Fprintf(w, "\x1b[H\x1b[2J%s", strings.Join(m.view(rows, cols), "\r\n"))
+		n, err := in.Read(buf)
+		if err != nil {
+			return fmt.Errorf("read terminal: %v", err)
+		}
+		for _, key := range parseKeys(buf[:n]) {
+			m.update(key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+// makeRaw is implemented only on linux, the termios ioctls differ between the systems.
+func makeRaw(fd int) (restore func(), err error) {
+	return nil, errors.New("raw terminal mode is supported only on linux")
+}
+
+// termSize returns the classic terminal size, makeRaw fails anyway.
+func termSize(fd int) (rows, cols int) {
+	return 24, 80
+}